@@ -0,0 +1,80 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by SendMessage, or sent as error events, so that callers
+// can tell with errors.Is what went wrong.
+var (
+	// ErrNoSession means no session could be started at all.
+	ErrNoSession = errors.New("no available session")
+	// ErrQueueTimeout means every session stayed busy for too long.
+	ErrQueueTimeout = errors.New("timeout waiting for available session")
+	// ErrConversationBusy means the session owning a conversation stayed busy
+	// for too long, or is gone.
+	ErrConversationBusy = errors.New("session of the conversation is not available")
+	// ErrRateLimited means Grok refused the message because of its usage limits.
+	ErrRateLimited = errors.New("rate limited by Grok")
+	// ErrLoggedOut means the session's account is no longer signed in.
+	ErrLoggedOut = errors.New("session is logged out of Grok")
+	// ErrChallenge means Grok showed a bot challenge page instead of the chat.
+	ErrChallenge = errors.New("blocked by a challenge page")
+	// ErrUpstream is any other failure of Grok or the browser.
+	ErrUpstream = errors.New("Grok request failed")
+)
+
+// GrokError is a failure reported by Grok, either as the HTTP status of the
+// conversation request or as an error in its response stream.
+type GrokError struct {
+	// StatusCode is the HTTP status, 0 when the error came in the stream
+	StatusCode int
+	// Code is the error code from the stream, 0 when there was none
+	Code    int
+	Message string
+	kind    error
+}
+
+func (e *GrokError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%v: status %d: %s", e.kind, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%v: %s", e.kind, e.Message)
+}
+
+// Unwrap returns the sentinel error the failure falls under.
+func (e *GrokError) Unwrap() error {
+	return e.kind
+}
+
+// Grok's stream reports errors with gRPC status codes.
+const (
+	grpcResourceExhausted = 8
+	grpcUnauthenticated   = 16
+)
+
+// newGrokError classifies a failure reported by Grok. challenge is set when
+// the response was a bot challenge rather than Grok's own answer.
+func newGrokError(statusCode int, code int, message string, challenge bool) *GrokError {
+	kind := ErrUpstream
+	switch {
+	case challenge:
+		kind = ErrChallenge
+	case statusCode == 429 || code == grpcResourceExhausted:
+		kind = ErrRateLimited
+	case statusCode == 401 || code == grpcUnauthenticated:
+		kind = ErrLoggedOut
+	}
+	return &GrokError{StatusCode: statusCode, Code: code, Message: message, kind: kind}
+}
+
+// upstreamError wraps a failure that has no more specific cause.
+func upstreamError(err error) error {
+	for _, kind := range []error{ErrRateLimited, ErrLoggedOut, ErrChallenge, ErrUpstream} {
+		if errors.Is(err, kind) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrUpstream, err)
+}
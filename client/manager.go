@@ -3,27 +3,41 @@ package client
 import (
 	"context"
 	"errors"
+	"grok-chat-proxy2/utils"
 	"log"
 	"os"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
 )
 
 type SessionManager struct {
-	sessions      map[int]*Session
-	nextAvailable chan *Session
-	private       bool
+	sessions map[int]*Session
+	mu       sync.Mutex
+	// idle are the free sessions, in the order they were freed, and waiters
+	// the messages waiting for one, first come first served
+	idle    []*Session
+	waiters []*sessionWaiter
 }
 
-func NewSessionManager(headless bool, private bool) *SessionManager {
+// sessionWaiter is a message waiting for a session, any session when id is
+// anySession. The session is handed to it on ch.
+type sessionWaiter struct {
+	id int
+	ch chan *Session
+}
+
+const anySession = -1
+
+func NewSessionManager(headless bool) *SessionManager {
 	sessions := make(map[int]*Session)
 	files, err := os.ReadDir("./userdata")
 	if err != nil {
 		log.Printf("Failed to read userdata directory: %v", err)
 		log.Printf("This means you should use `-n <number>` to start <number> sessions")
 		log.Printf("We will create 1 session for you.")
-		return NewSessionManagerN(1, headless, private)
+		return NewSessionManagerN(1, headless)
 	}
 	ch := make(chan *Session)
 	wg := sync.WaitGroup{}
@@ -49,24 +63,23 @@ func NewSessionManager(headless bool, private bool) *SessionManager {
 			}(id)
 		}
 	}
-	nextAvailable := make(chan *Session, n)
 	go func() {
 		wg.Wait()
 		close(ch)
 	}()
+	var idle []*Session
 	for session := range ch {
 		sessions[session.id] = session
-		nextAvailable <- session
+		idle = append(idle, session)
 	}
-	return &SessionManager{sessions: sessions, nextAvailable: nextAvailable, private: private}
+	return &SessionManager{sessions: sessions, idle: idle}
 }
 
-func NewSessionManagerN(n int, headless bool, private bool) *SessionManager {
+func NewSessionManagerN(n int, headless bool) *SessionManager {
 	sessions := make(map[int]*Session)
 	ch := make(chan *Session)
 	wg := sync.WaitGroup{}
 	wg.Add(n)
-	nextAvailable := make(chan *Session, n)
 	for i := range n {
 		go func(i int) {
 			defer wg.Done()
@@ -82,20 +95,20 @@ func NewSessionManagerN(n int, headless bool, private bool) *SessionManager {
 		wg.Wait()
 		close(ch)
 	}()
+	var idle []*Session
 	for session := range ch {
 		sessions[session.id] = session
-		nextAvailable <- session
+		idle = append(idle, session)
 	}
-	return &SessionManager{sessions: sessions, nextAvailable: nextAvailable, private: private}
+	return &SessionManager{sessions: sessions, idle: idle}
 }
 
-func NewSessionManagerWithCookie(cookieList []string, headless bool, private bool) *SessionManager {
+func NewSessionManagerWithCookie(cookieList []string, headless bool) *SessionManager {
 	sessions := make(map[int]*Session)
 	ch := make(chan *Session)
 	wg := sync.WaitGroup{}
 	n := len(cookieList)
 	wg.Add(n)
-	nextAvailable := make(chan *Session, n)
 	for i, cookieString := range cookieList {
 		go func(i int, cookieString string) {
 			defer wg.Done()
@@ -111,45 +124,121 @@ func NewSessionManagerWithCookie(cookieList []string, headless bool, private boo
 		wg.Wait()
 		close(ch)
 	}()
+	var idle []*Session
 	for session := range ch {
 		sessions[session.id] = session
-		nextAvailable <- session
+		idle = append(idle, session)
 	}
-	return &SessionManager{sessions: sessions, nextAvailable: nextAvailable, private: private}
+	return &SessionManager{sessions: sessions, idle: idle}
 }
 
-func (sm *SessionManager) SendMessage(model string, prompt *string, filename *string, responseChan chan string) (context.CancelFunc, error) {
-	timer := time.NewTimer(5 * time.Second)
-	defer timer.Stop()
-	var session *Session
-	select {
-	case <-timer.C:
-		errMsg := "timeout waiting for available session"
-		log.Println(errMsg)
+// queueTimeout is how long a message waits for a session.
+const queueTimeout = 5 * time.Second
+
+// SendMessage sends the prompt using the next available session, or posts it
+// into the conversation on the session owning it when conversation is set.
+// Events are delivered on responseChan, which is closed once the answer is
+// over, so the caller must drain it. Cancelling the returned function stops
+// the answer, and the session is only released once Grok has stopped
+// generating. The raw answer stream is written to the file capture, unless it
+// is empty.
+func (sm *SessionManager) SendMessage(model utils.Model, conversation *utils.Conversation, prompt *string, filenames []string, capture string, responseChan chan utils.Event) (context.CancelFunc, error) {
+	if len(sm.sessions) == 0 {
+		log.Println(ErrNoSession)
 		close(responseChan)
-		return nil, errors.New(errMsg)
-	case session = <-sm.nextAvailable:
+		return nil, ErrNoSession
+	}
+	var session *Session
+	conversationID := ""
+	if conversation != nil {
+		conversationID = conversation.ConversationID
+		if _, ok := sm.sessions[conversation.Session]; ok {
+			session = sm.takeSession(conversation.Session)
+		}
+		if session == nil {
+			log.Printf("Session %d: %v", conversation.Session, ErrConversationBusy)
+			close(responseChan)
+			return nil, ErrConversationBusy
+		}
+	} else {
+		session = sm.takeSession(anySession)
 		if session == nil {
-			errMsg := "no available session"
-			log.Println(errMsg)
+			log.Println(ErrQueueTimeout)
 			close(responseChan)
-			return nil, errors.New(errMsg)
+			return nil, ErrQueueTimeout
 		}
 	}
 	listenCtx, cancelListen := context.WithCancel(*session.ctx)
 	go func() {
-		err := session.SendMessage(model, prompt, filename, sm.private, responseChan, listenCtx, cancelListen)
-		if err != nil {
+		err := session.SendMessage(model, conversationID, prompt, filenames, capture, responseChan, listenCtx, cancelListen)
+		if err != nil && !errors.Is(err, context.Canceled) {
 			log.Printf("Failed to send message: %v", err)
-			sm.nextAvailable <- session
-			return
-		} else {
-			sm.nextAvailable <- session
+			responseChan <- utils.ErrorEvent(err)
+		}
+		close(responseChan)
+		if listenCtx.Err() != nil {
+			// the answer was abandoned, Grok may still be generating it
+			session.StopGeneration()
 		}
+		sm.releaseSession(session)
 	}()
 	return cancelListen, nil
 }
 
+// takeSession waits up to queueTimeout for a free session, the one with the
+// given id unless id is anySession. It returns nil when none was freed in
+// time.
+func (sm *SessionManager) takeSession(id int) *Session {
+	sm.mu.Lock()
+	for i, session := range sm.idle {
+		if id == anySession || session.id == id {
+			sm.idle = slices.Delete(sm.idle, i, i+1)
+			sm.mu.Unlock()
+			return session
+		}
+	}
+	waiter := &sessionWaiter{id: id, ch: make(chan *Session, 1)}
+	sm.waiters = append(sm.waiters, waiter)
+	sm.mu.Unlock()
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case session := <-waiter.ch:
+		return session
+	case <-timer.C:
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if i := slices.Index(sm.waiters, waiter); i >= 0 {
+		sm.waiters = slices.Delete(sm.waiters, i, i+1)
+		return nil
+	}
+	// a session was handed over just as the wait ran out
+	return <-waiter.ch
+}
+
+// releaseSession hands the session to the first message waiting for it, or
+// puts it back with the idle ones.
+func (sm *SessionManager) releaseSession(session *Session) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for i, waiter := range sm.waiters {
+		if waiter.id == anySession || waiter.id == session.id {
+			sm.waiters = slices.Delete(sm.waiters, i, i+1)
+			waiter.ch <- session
+			return
+		}
+	}
+	sm.idle = append(sm.idle, session)
+}
+
+// Idle returns how many sessions are waiting for a message.
+func (sm *SessionManager) Idle() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return len(sm.idle)
+}
+
 func (sm *SessionManager) Close() {
 	for _, session := range sm.sessions {
 		session.Close()
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestManager(n int) *SessionManager {
+	sm := &SessionManager{sessions: map[int]*Session{}}
+	for i := range n {
+		session := &Session{id: i}
+		sm.sessions[i] = session
+		sm.idle = append(sm.idle, session)
+	}
+	return sm
+}
+
+func TestTakeSession(t *testing.T) {
+	sm := newTestManager(3)
+	if session := sm.takeSession(1); session == nil || session.id != 1 {
+		t.Fatalf("got %v, want session 1", session)
+	}
+	if idle := sm.Idle(); idle != 2 {
+		t.Errorf("%d sessions idle, want 2", idle)
+	}
+	if session := sm.takeSession(anySession); session == nil || session.id != 0 {
+		t.Fatalf("got %v, want session 0", session)
+	}
+}
+
+func TestTakeSessionWaitsForItsSession(t *testing.T) {
+	sm := newTestManager(2)
+	busy := sm.takeSession(1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sm.releaseSession(busy)
+	}()
+	// the other session stays free for other messages meanwhile
+	if session := sm.takeSession(1); session != busy {
+		t.Fatalf("got %v, want session 1", session)
+	}
+	if idle := sm.Idle(); idle != 1 {
+		t.Errorf("%d sessions idle, want 1", idle)
+	}
+}
+
+func TestReleaseSessionHandsOverInOrder(t *testing.T) {
+	sm := newTestManager(1)
+	session := sm.takeSession(anySession)
+	got := make(chan *Session, 2)
+	go func() { got <- sm.takeSession(anySession) }()
+	for len(sm.waiting()) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { got <- sm.takeSession(0) }()
+	for len(sm.waiting()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	sm.releaseSession(session)
+	first := <-got
+	sm.releaseSession(first)
+	if second := <-got; first != session || second != session {
+		t.Errorf("got %v and %v, want the session twice", first, second)
+	}
+	if sm.Idle() != 0 || len(sm.waiting()) != 0 {
+		t.Errorf("%d idle and %d waiting, want none", sm.Idle(), len(sm.waiting()))
+	}
+}
+
+func TestTakeSessionConcurrently(t *testing.T) {
+	sm := newTestManager(4)
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := anySession
+			if i%3 == 0 {
+				id = i % 4
+			}
+			session := sm.takeSession(id)
+			if session == nil || (id != anySession && session.id != id) {
+				t.Errorf("asked for session %d, got %v", id, session)
+				return
+			}
+			time.Sleep(time.Millisecond)
+			sm.releaseSession(session)
+		}()
+	}
+	wg.Wait()
+	if sm.Idle() != 4 || len(sm.waiting()) != 0 {
+		t.Errorf("%d idle and %d waiting, want 4 and none", sm.Idle(), len(sm.waiting()))
+	}
+}
+
+// waiting returns the messages waiting for a session.
+func (sm *SessionManager) waiting() []*sessionWaiter {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.waiters
+}
@@ -157,7 +157,15 @@ Object.defineProperty(navigator, 'webdriver', {
 }
 
 func (s *Session) navigateToHomepage() error {
-	targetURL := "https://grok.com"
+	return s.navigate("https://grok.com")
+}
+
+// navigateToConversation opens an existing chat to post into.
+func (s *Session) navigateToConversation(conversationID string) error {
+	return s.navigate("https://grok.com/chat/" + conversationID)
+}
+
+func (s *Session) navigate(targetURL string) error {
 	tasks := chromedp.Tasks{
 		chromedp.Navigate(targetURL),
 	}
@@ -217,9 +225,10 @@ var (
 	grokDeepSearchButtonSelector   = `button[aria-label="DeepSearch"]`
 	grokExpandButtonSelector       = `div.rounded-full button:nth-of-type(2)`
 	grokDeeperSearchButtonSelector = `div[aria-label="DeeperSearch"]`
+	grokStopButtonSelector         = `button[aria-label^="Stop"]`
 )
 
-func (s *Session) sendPrompt(model string, prompt *string, filename *string, private bool, cancelListen context.CancelFunc, listenCtx context.Context) error {
+func (s *Session) sendPrompt(model utils.Model, prompt *string, filenames []string, cancelListen context.CancelFunc, listenCtx context.Context) error {
 	jsonPrompt, err := json.Marshal(*prompt)
 	if err != nil {
 		log.Printf("Failed to marshal prompt: %v", err)
@@ -233,26 +242,27 @@ func (s *Session) sendPrompt(model string, prompt *string, filename *string, pri
 		chromedp.WaitReady(grokSendButtonSelector, chromedp.ByQuery),
 		chromedp.EvaluateAsDevTools(setMessage, nil),
 	}
-	if filename != nil {
-		files := []string{*filename}
+	// one file at a time, the composer adds each selection to the attachments
+	for _, filename := range filenames {
+		files := []string{filename}
 		tasks = append(tasks, chromedp.SetUploadFiles(grokInputFileSelector, files, chromedp.ByQuery))
 	}
-	if private {
+	if model.Private {
 		clickPrivateButton := fmt.Sprintf(jsClickTemplate, grokPrivateButtonSelector)
 		tasks = append(tasks, chromedp.WaitVisible(grokPrivateButtonSelector, chromedp.ByQuery))
 		tasks = append(tasks, chromedp.EvaluateAsDevTools(clickPrivateButton, nil))
 	}
-	if strings.HasSuffix(model, "think") {
+	if model.Think {
 		clickThinkButton := fmt.Sprintf(jsClickTemplate, grokThinkButtonSelector)
 		tasks = append(tasks, chromedp.WaitVisible(grokThinkButtonSelector, chromedp.ByQuery))
 		tasks = append(tasks, chromedp.EvaluateAsDevTools(clickThinkButton, nil))
 	}
-	if strings.HasSuffix(model, "deepsearch") {
+	if model.DeepSearch {
 		clickDeepSearchButton := fmt.Sprintf(jsClickTemplate, grokDeepSearchButtonSelector)
 		tasks = append(tasks, chromedp.WaitVisible(grokPrivateButtonSelector, chromedp.ByQuery))
 		tasks = append(tasks, chromedp.EvaluateAsDevTools(clickDeepSearchButton, nil))
 	}
-	if strings.HasSuffix(model, "deepersearch") {
+	if model.DeeperSearch {
 		clickExpandButton := fmt.Sprintf(jsRobustClickTemplate, grokExpandButtonSelector)
 		clickDeeperSearchButton := fmt.Sprintf(jsClickTemplate, grokDeeperSearchButtonSelector)
 		tasks = append(tasks, chromedp.WaitVisible(grokExpandButtonSelector, chromedp.ByQuery))
@@ -274,27 +284,53 @@ func (s *Session) sendPrompt(model string, prompt *string, filename *string, pri
 	return nil
 }
 
-func (s *Session) listenForResponse(model string, responseChan chan string, listenCtx context.Context) error {
+// listenForResponse streams the answer of the request that creates a new
+// conversation, or of the one posting into conversationID when it is set.
+// The raw stream is written to capture when it is set.
+func (s *Session) listenForResponse(model utils.Model, conversationID string, capture string, responseChan chan utils.Event, listenCtx context.Context) error {
 	listenURL := "https://grok.com/rest/app-chat/conversations"
-	log.Printf("Listening for response at %s", listenURL)
+	listenSuffix := "/new"
+	if conversationID != "" {
+		listenSuffix = "/" + conversationID + "/responses"
+	}
+	log.Printf("Listening for response at %s", listenURL+listenSuffix)
 
 	var muId sync.Mutex
 	var listenRequestID network.RequestID
 	requestIDFound := false
+	stopped := false
 
-	// FIXME: this is a workaround, the correct way is to make this channel one-time usable
-	// which means once someone sends a message, the channel is closed
+	// done is never closed, senders must not block on it since the listener
+	// may still receive events after this function returns
 	done := make(chan error, 3)
-	defer close(done)
+	notify := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
 	head := false
 	timer := time.NewTimer(TIMEOUT)
 	defer timer.Stop()
 	dataChannel := make(chan string, 20)
-	defer close(dataChannel)
 	processCtx, cancelProcess := context.WithCancel(listenCtx)
 	defer cancelProcess()
 	wg := sync.WaitGroup{}
-	go ProcessData(model, dataChannel, processCtx, cancelProcess, responseChan)
+	processDone := make(chan struct{})
+	go func() {
+		defer close(processDone)
+		ProcessData(model.Parser, s.id, capture, dataChannel, processCtx, cancelProcess, responseChan)
+	}()
+	// finish stops forwarding data and waits for the parser, so that nothing is
+	// sent to responseChan once listenForResponse has returned
+	finish := func() {
+		muId.Lock()
+		stopped = true
+		muId.Unlock()
+		wg.Wait()
+		close(dataChannel)
+		<-processDone
+	}
 	chromedp.ListenTarget(listenCtx, func(event interface{}) {
 		if listenCtx.Err() != nil {
 			return
@@ -302,7 +338,7 @@ func (s *Session) listenForResponse(model string, responseChan chan string, list
 		switch event := event.(type) {
 		case *network.EventRequestWillBeSent:
 			muId.Lock()
-			predication := !requestIDFound && event.Request.Method == "POST" && strings.Contains(event.Request.URL, listenURL) && strings.HasSuffix(event.Request.URL, "/new")
+			predication := !requestIDFound && event.Request.Method == "POST" && strings.Contains(event.Request.URL, listenURL) && strings.HasSuffix(event.Request.URL, listenSuffix)
 			muId.Unlock()
 			if predication {
 				log.Printf("Streaming request identified: %s %s (ID: %s)", event.Request.Method, event.Request.URL, event.RequestID)
@@ -320,16 +356,18 @@ func (s *Session) listenForResponse(model string, responseChan chan string, list
 					err := chromedp.Run(listenCtx, task)
 					if err != nil {
 						log.Printf("Error streaming resource content: %v", err)
-						done <- err
+						notify(err)
 					}
 				}()
 			}
 		case *network.EventDataReceived:
 			muId.Lock()
-			predication := requestIDFound && event.RequestID == listenRequestID
-			muId.Unlock()
+			predication := requestIDFound && !stopped && event.RequestID == listenRequestID
 			if predication {
 				wg.Add(1)
+			}
+			muId.Unlock()
+			if predication {
 				go func() {
 					defer wg.Done()
 					muId.Lock()
@@ -346,13 +384,23 @@ func (s *Session) listenForResponse(model string, responseChan chan string, list
 					}
 				}()
 			}
+		case *network.EventResponseReceived:
+			muId.Lock()
+			predication := requestIDFound && event.RequestID == listenRequestID
+			muId.Unlock()
+			if predication && event.Response.Status >= 400 {
+				challenge := event.Response.Headers["cf-mitigated"] == "challenge"
+				log.Printf("Request ID %s failed with status %d", event.RequestID, event.Response.Status)
+				notify(newGrokError(int(event.Response.Status), 0, event.Response.StatusText, challenge))
+				return
+			}
 		case *network.EventLoadingFinished:
 			muId.Lock()
 			predication := requestIDFound && event.RequestID == listenRequestID
 			muId.Unlock()
 			if predication {
 				log.Printf("Loading finished for request ID %s", event.RequestID)
-				done <- nil
+				notify(nil)
 				return
 			}
 		case *network.EventLoadingFailed:
@@ -361,7 +409,7 @@ func (s *Session) listenForResponse(model string, responseChan chan string, list
 			muId.Unlock()
 			if predication {
 				log.Printf("Loading failed for request ID %s: %s", event.RequestID, event.ErrorText)
-				done <- fmt.Errorf("loading failed for request ID %s: %s", event.RequestID, event.ErrorText)
+				notify(fmt.Errorf("loading failed for request ID %s: %s", event.RequestID, event.ErrorText))
 				return
 			}
 		}
@@ -373,11 +421,10 @@ func (s *Session) listenForResponse(model string, responseChan chan string, list
 			if err != nil {
 				log.Printf("ListenForResponse completed with error: %v", err)
 				cancelProcess()
-				wg.Wait()
+				finish()
 				return err
 			} else {
-				cancelProcess()
-				wg.Wait()
+				finish()
 				return nil
 			}
 		case <-timer.C:
@@ -388,46 +435,147 @@ func (s *Session) listenForResponse(model string, responseChan chan string, list
 				errMsg := fmt.Sprintf("Timeout waiting for response after %v seconds", TIMEOUT.Seconds())
 				log.Println(errMsg)
 				cancelProcess()
-				wg.Wait()
+				finish()
 				return errors.New(errMsg)
 			}
 		case <-listenCtx.Done():
-			wg.Wait()
+			finish()
 			log.Printf("ListenForResponse cancelled by parent context before timeout or completion.")
 			return listenCtx.Err()
 		case <-processCtx.Done():
-			wg.Wait()
+			finish()
 			log.Printf("Finished processing data.")
 			return nil
 		}
 	}
 }
 
-func (s *Session) SendMessage(model string, prompt *string, filename *string, private bool, responseChan chan string, listenCtx context.Context, cancelListen context.CancelFunc) error {
-	err := s.navigateToHomepage()
+// SendMessage sends the prompt and streams the answer to responseChan. The
+// prompt starts a new chat, or is posted into conversationID when it is set.
+// Errors wrap one of the sentinel errors of this package, except when
+// listenCtx was cancelled by the caller. The raw answer stream is written to
+// capture when it is set.
+func (s *Session) SendMessage(model utils.Model, conversationID string, prompt *string, filenames []string, capture string, responseChan chan utils.Event, listenCtx context.Context, cancelListen context.CancelFunc) error {
+	var err error
+	if conversationID != "" {
+		err = s.navigateToConversation(conversationID)
+	} else {
+		err = s.navigateToHomepage()
+	}
 	if err != nil {
-		log.Printf("Failed to navigate to homepage: %v", err)
+		log.Printf("Failed to navigate: %v", err)
+		return upstreamError(err)
+	}
+	if err := s.checkPage(); err != nil {
+		log.Printf("Session %d cannot chat: %v", s.id, err)
 		return err
 	}
 	ch := make(chan error, 1)
 	go func() {
-		err := s.listenForResponse(model, responseChan, listenCtx)
+		err := s.listenForResponse(model, conversationID, capture, responseChan, listenCtx)
+		if err != nil {
+			// stop sendPrompt from waiting on a page that will not answer
+			cancelListen()
+		}
 		ch <- err
 	}()
-	err = s.sendPrompt(model, prompt, filename, private, cancelListen, listenCtx)
+	err = s.sendPrompt(model, prompt, filenames, cancelListen, listenCtx)
 	if err != nil {
 		log.Printf("Failed to send prompt: %v", err)
-		return err
+		if listenErr := <-ch; listenErr != nil && !errors.Is(listenErr, context.Canceled) {
+			err = listenErr
+		}
+		return s.diagnose(err)
 	}
 	err = <-ch
 	if err != nil {
 		log.Printf("Failed to listen for response: %v", err)
-		return err
+		return s.diagnose(err)
 	}
 	log.Printf("Message sent successfully.")
 	return nil
 }
 
+var jsClickIfPresentTemplate = `(function (){
+let el = document.querySelector('%s');
+if (!el) {
+	return false;
+}
+el.click();
+return true;
+})();
+`
+
+// StopGeneration stops an answer that is no longer wanted, so it does not use
+// up the account's quota, and waits for the page to be ready for the next
+// message. If Grok does not stop, the page is reloaded, which aborts the
+// request.
+func (s *Session) StopGeneration() {
+	ctx, cancel := context.WithTimeout(*s.ctx, 10*time.Second)
+	defer cancel()
+	clickStopButton := fmt.Sprintf(jsClickIfPresentTemplate, grokStopButtonSelector)
+	var clicked bool
+	err := chromedp.Run(ctx, chromedp.EvaluateAsDevTools(clickStopButton, &clicked))
+	if err == nil && !clicked {
+		return
+	}
+	if err == nil {
+		log.Printf("Session %d: stopping generation", s.id)
+		err = chromedp.Run(ctx, chromedp.WaitNotPresent(grokStopButtonSelector, chromedp.ByQuery))
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("Session %d: failed to stop generation, reloading: %v", s.id, err)
+	if err := s.navigateToHomepage(); err != nil {
+		log.Printf("Session %d: failed to reload: %v", s.id, err)
+	}
+}
+
+var jsPageState = `(function (){
+if (document.title.includes('Just a moment') || document.querySelector('#challenge-form, iframe[src*="challenges.cloudflare.com"]')) {
+	return 'challenge';
+}
+if (location.pathname.startsWith('/sign-in') || location.hostname.startsWith('accounts.')) {
+	return 'logged_out';
+}
+return '';
+})();
+`
+
+// checkPage reports a challenge page or a sign-in page shown instead of the
+// chat. It returns nil when the page cannot be inspected.
+func (s *Session) checkPage() error {
+	ctx, cancel := context.WithTimeout(*s.ctx, 5*time.Second)
+	defer cancel()
+	var state string
+	if err := chromedp.Run(ctx, chromedp.EvaluateAsDevTools(jsPageState, &state)); err != nil {
+		log.Printf("Failed to check page state: %v", err)
+		return nil
+	}
+	switch state {
+	case "challenge":
+		return ErrChallenge
+	case "logged_out":
+		return ErrLoggedOut
+	}
+	return nil
+}
+
+// diagnose explains a failed message. Most failures are symptoms of a
+// challenge or sign-in page, so the page is checked before falling back to a
+// generic upstream error.
+func (s *Session) diagnose(err error) error {
+	var grokErr *GrokError
+	if errors.Is(err, context.Canceled) || errors.As(err, &grokErr) {
+		return err
+	}
+	if pageErr := s.checkPage(); pageErr != nil {
+		return fmt.Errorf("%w: %v", pageErr, err)
+	}
+	return upstreamError(err)
+}
+
 func (s *Session) Close() {
 	if s.release != nil {
 		s.release()
@@ -435,14 +583,24 @@ func (s *Session) Close() {
 	log.Printf("Session %d closed.", s.id)
 }
 
-func ProcessData(model string, dataChannel chan string, ctx context.Context, cancel context.CancelFunc, responseChan chan string) {
+// ProcessData decodes the raw stream into lines and hands them to the named
+// parser, which writes them to capture when it is set. It returns once the
+// parser has exited.
+func ProcessData(parser string, session int, capture string, dataChannel chan string, ctx context.Context, cancel context.CancelFunc, responseChan chan utils.Event) {
 	lineChannel := make(chan string, 20)
-	defer close(lineChannel)
-	if strings.HasSuffix(model, "search") {
-		go ParseDataDeepSearch(lineChannel, ctx, cancel, responseChan)
-	} else {
-		go ParseData(lineChannel, ctx, cancel, responseChan)
-	}
+	parseDone := make(chan struct{})
+	go func() {
+		defer close(parseDone)
+		if parser == utils.ParserDeepSearch {
+			ParseDataDeepSearch(lineChannel, session, capture, ctx, cancel, responseChan)
+		} else {
+			ParseData(lineChannel, session, capture, ctx, cancel, responseChan)
+		}
+	}()
+	defer func() {
+		close(lineChannel)
+		<-parseDone
+	}()
 	for data := range dataChannel {
 		bytes, err := utils.Base64Decode(data)
 		if err != nil {
@@ -459,19 +617,59 @@ func ProcessData(model string, dataChannel chan string, ctx context.Context, can
 	}
 }
 
-func ParseData(lineChannel chan string, ctx context.Context, cancel context.CancelFunc, responseChan chan string) {
-	defer close(responseChan)
-	defer cancel()
-	think := false
-	thinkTag := "<think>"
-	var file bool
-	f, err := os.OpenFile("./response.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+// metadataTracker remembers the ids Grok has reported so far, so that a
+// metadata event is only emitted when one of them changes.
+type metadataTracker struct {
+	session        int
+	conversationID string
+	responseID     string
+}
+
+func (m *metadataTracker) update(line string, responseID string) (utils.Event, bool) {
+	changed := false
+	conversation, _ := utils.ParseGrokConversation(line)
+	if conversation != nil && conversation.ConversationId != "" && conversation.ConversationId != m.conversationID {
+		m.conversationID = conversation.ConversationId
+		changed = true
+	}
+	if responseID != "" && responseID != m.responseID {
+		m.responseID = responseID
+		changed = true
+	}
+	return utils.MetadataEvent(m.session, m.conversationID, m.responseID), changed
+}
+
+// openCapture creates the file the raw stream is written to. It returns nil
+// when there is no capture file or it cannot be created.
+func openCapture(capture string) *os.File {
+	if capture == "" {
+		return nil
+	}
+	f, err := os.Create(capture)
 	if err != nil {
 		log.Printf("Failed to open file: %v", err)
 		log.Printf("Processing data without file output.")
-	} else {
+		return nil
+	}
+	return f
+}
+
+func sendEvent(ctx context.Context, responseChan chan utils.Event, event utils.Event) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case responseChan <- event:
+		return true
+	}
+}
+
+func ParseData(lineChannel chan string, session int, capture string, ctx context.Context, cancel context.CancelFunc, responseChan chan utils.Event) {
+	defer cancel()
+	metadata := metadataTracker{session: session}
+	f := openCapture(capture)
+	file := f != nil
+	if file {
 		defer f.Close()
-		file = true
 	}
 	for line := range lineChannel {
 		line = strings.TrimSpace(line)
@@ -485,43 +683,46 @@ func ParseData(lineChannel chan string, ctx context.Context, cancel context.Canc
 			}
 		}
 		response, _ := utils.ParseGrokResponse(line)
+		responseID := ""
+		if response != nil {
+			responseID = response.ResponseId
+		}
+		if event, changed := metadata.update(line, responseID); changed {
+			if !sendEvent(ctx, responseChan, event) {
+				return
+			}
+		}
+		if grokErr, _ := utils.ParseGrokError(line); grokErr != nil {
+			log.Printf("Grok reported an error: %d %s", grokErr.Code, grokErr.Message)
+			sendEvent(ctx, responseChan, utils.ErrorEvent(newGrokError(0, grokErr.Code, grokErr.Message, false)))
+			return
+		}
 		if response == nil {
 			continue
 		}
-		delta := ""
-		if response.IsThinking != think {
-			delta += fmt.Sprintf("\n%s\n", thinkTag)
-			think = !think
-			thinkTag = "</think>"
+		event := utils.TextEvent(response.Token)
+		if response.IsThinking {
+			event = utils.ReasoningEvent(response.Token)
 		}
-		delta += response.Token
-		fmt.Print(delta)
-		select {
-		case <-ctx.Done():
+		fmt.Print(response.Token)
+		if !sendEvent(ctx, responseChan, event) {
 			return
-		case responseChan <- delta:
 		}
 		if response.IsSoftStop {
 			fmt.Println()
+			sendEvent(ctx, responseChan, utils.FinishEvent("stop"))
 			return
 		}
 	}
 }
 
-func ParseDataDeepSearch(lineChannel chan string, ctx context.Context, cancel context.CancelFunc, responseChan chan string) {
-	defer close(responseChan)
+func ParseDataDeepSearch(lineChannel chan string, session int, capture string, ctx context.Context, cancel context.CancelFunc, responseChan chan utils.Event) {
 	defer cancel()
-	tag := "<research>"
-	inResearch := false
-	inFinal := false
-	var file bool
-	f, err := os.OpenFile("./response.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Printf("Failed to open file: %v", err)
-		log.Printf("Processing data without file output.")
-	} else {
+	metadata := metadataTracker{session: session}
+	f := openCapture(capture)
+	file := f != nil
+	if file {
 		defer f.Close()
-		file = true
 	}
 	for line := range lineChannel {
 		line = strings.TrimSpace(line)
@@ -535,28 +736,34 @@ func ParseDataDeepSearch(lineChannel chan string, ctx context.Context, cancel co
 			}
 		}
 		response, _ := utils.ParseGrokResponse(line)
+		responseID := ""
+		if response != nil {
+			responseID = response.ResponseId
+		}
+		if event, changed := metadata.update(line, responseID); changed {
+			if !sendEvent(ctx, responseChan, event) {
+				return
+			}
+		}
+		if grokErr, _ := utils.ParseGrokError(line); grokErr != nil {
+			log.Printf("Grok reported an error: %d %s", grokErr.Code, grokErr.Message)
+			sendEvent(ctx, responseChan, utils.ErrorEvent(newGrokError(0, grokErr.Code, grokErr.Message, false)))
+			return
+		}
 		if response == nil {
 			continue
 		}
-		delta := ""
-		if !inResearch {
-			delta += fmt.Sprintf("\n%s\n", tag)
-			inResearch = true
-			tag = "</research>"
-		}
-		if !inFinal && response.MessageTag == "final" {
-			delta += fmt.Sprintf("\n%s\n", tag)
-			inFinal = true
+		event := utils.TextEvent(response.Token)
+		if response.MessageTag != "final" {
+			event = utils.ResearchEvent(response.MessageStepId, response.Token)
 		}
-		delta += response.Token
-		fmt.Print(delta)
-		select {
-		case <-ctx.Done():
+		fmt.Print(response.Token)
+		if !sendEvent(ctx, responseChan, event) {
 			return
-		case responseChan <- delta:
 		}
 		if response.IsSoftStop {
 			fmt.Println()
+			sendEvent(ctx, responseChan, utils.FinishEvent("stop"))
 			return
 		}
 	}
@@ -7,11 +7,15 @@ import (
 	"grok-chat-proxy2/client"
 	"grok-chat-proxy2/server"
 	"grok-chat-proxy2/utils"
+	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -25,36 +29,133 @@ func main() {
 	var sessionNumber int
 	flag.IntVar(&sessionNumber, "n", 0, "Number of sessions to create")
 	var privateFlag bool
-	flag.BoolVar(&privateFlag, "p", false, "Use private mode")
+	flag.BoolVar(&privateFlag, "p", false, "Use private mode by default")
+	var reasoningMode string
+	flag.StringVar(&reasoningMode, "reasoning", server.ReasoningInline, "How to return thinking: `inline` (tags in content), separate (reasoning_content) or none")
+	var imageDir string
+	flag.StringVar(&imageDir, "images", "", "Allow image parts to refer to local files under `dir` (disabled when empty)")
+	var jsonAttempts int
+	flag.IntVar(&jsonAttempts, "json-attempts", 3, "How many times to ask Grok for valid JSON in JSON mode before failing")
+	var modelsFile string
+	flag.StringVar(&modelsFile, "models", "", "Read the served models from a JSON `file` (the built-in grok-3 models when empty)")
+	var keysFile string
+	flag.StringVar(&keysFile, "keys", "", "Accept the API keys in a JSON `file`, each with the grok options it may set")
+	var conversationsFile string
+	flag.StringVar(&conversationsFile, "conversations", "", "Save the Grok conversations requests can continue to `file`, e.g. data/conversations.json (kept in memory only when empty)")
+	var conversationTTL time.Duration
+	flag.DurationVar(&conversationTTL, "conversation-ttl", 24*time.Hour, "Forget conversations not continued for this long")
+	var promptTemplate string
+	flag.StringVar(&promptTemplate, "template", "plain", "Write prompts with a preset (plain, xml or chatml) or a Go template `file`")
+	var roles string
+	flag.StringVar(&roles, "roles", "", "Relabel roles in prompts, as comma separated role=label `pairs`, e.g. user=user")
+	var promptLength int
+	flag.IntVar(&promptLength, "prompt-length", server.MAX_PROMPT_LENGTH, "Upload the history of prompts longer than this many characters as files instead of typing it in")
+	var attachmentSize int
+	flag.IntVar(&attachmentSize, "attachment-size", 100000, "Split uploaded prompts into files of at most this many characters")
+	var dataDir string
+	flag.StringVar(&dataDir, "data", "data", "Keep the prompt, raw response and uploads of each request in a directory under `dir`/requests")
+	var requestTTL time.Duration
+	flag.DurationVar(&requestTTL, "request-ttl", 24*time.Hour, "Remove request directories older than this")
+	var maxRequests int
+	flag.IntVar(&maxRequests, "max-requests", 100, "Keep the directories of at most this many requests")
+	var transcriptsFlag bool
+	flag.BoolVar(&transcriptsFlag, "transcripts", false, "Archive every request with its prompts, raw Grok responses and output in transcripts.jsonl in the data dir, kept as long as the request directories")
+	var replayID string
+	flag.StringVar(&replayID, "replay", "", "Replay the archived request with this `id` on the running server (at -port, as admin -i) and print the response")
 	var port int
 	flag.IntVar(&port, "port", 9867, "Port to listen on")
 	flag.Parse()
+	if replayID != "" {
+		if err := replay(port, token, replayID); err != nil {
+			log.Fatalf("Failed to replay %s: %v", replayID, err)
+		}
+		return
+	}
+	if err := server.ConfigureReasoningMode(reasoningMode); err != nil {
+		log.Fatalf("Invalid reasoning mode: %v", err)
+	}
+	if roles != "" {
+		if err := utils.ConfigureRoleMap(roles); err != nil {
+			log.Fatalf("Invalid roles: %v", err)
+		}
+	}
+	if err := utils.ConfigurePromptTemplate(promptTemplate); err != nil {
+		log.Fatalf("Invalid template: %v", err)
+	}
+	if modelsFile != "" {
+		registry, err := utils.LoadModels(modelsFile)
+		if err != nil {
+			log.Fatalf("Failed to load models: %v", err)
+		}
+		server.ConfigureModels(registry)
+	}
+	if keysFile != "" {
+		keys, err := utils.LoadAPIKeys(keysFile)
+		if err != nil {
+			log.Fatalf("Failed to load API keys: %v", err)
+		}
+		server.ConfigureAPIKeys(keys)
+	}
+	if err := server.ConfigureDataDir(dataDir, requestTTL, maxRequests); err != nil {
+		log.Fatalf("Failed to set up the data dir: %v", err)
+	}
+	if transcriptsFlag {
+		if err := server.ConfigureTranscripts(filepath.Join(dataDir, "transcripts.jsonl")); err != nil {
+			log.Fatalf("Failed to load the transcripts: %v", err)
+		}
+	}
+	if err := server.ConfigureConversationStore(conversationsFile, conversationTTL); err != nil {
+		log.Fatalf("Failed to load conversations: %v", err)
+	}
 	var sm *client.SessionManager
 	if cookiesFlag {
 		cookies, err := utils.ReadCookies()
 		if err != nil {
 			log.Fatalf("Failed to read cookies: %v", err)
 		}
-		sm = client.NewSessionManagerWithCookie(cookies, headlessFlag, privateFlag)
+		sm = client.NewSessionManagerWithCookie(cookies, headlessFlag)
 	} else if sessionNumber > 0 {
-		sm = client.NewSessionManagerN(sessionNumber, headlessFlag, privateFlag)
+		sm = client.NewSessionManagerN(sessionNumber, headlessFlag)
 	} else {
-		sm = client.NewSessionManager(headlessFlag, privateFlag)
+		sm = client.NewSessionManager(headlessFlag)
 	}
 	defer sm.Close()
-	grokAPI := func(model string, prompt *string, responseChan chan string) (context.CancelFunc, error) {
-		return sm.SendMessage(model, prompt, nil, responseChan)
+	grokAPI := func(model utils.Model, conversation *utils.Conversation, prompt *string, capture string, responseChan chan utils.Event) (context.CancelFunc, error) {
+		return sm.SendMessage(model, conversation, prompt, nil, capture, responseChan)
 	}
-	grokAPIUsingFile := func(model string, prompt *string, filename string, responseChan chan string) (context.CancelFunc, error) {
-		return sm.SendMessage(model, prompt, &filename, responseChan)
+	grokAPIWithFiles := func(model utils.Model, conversation *utils.Conversation, prompt *string, filenames []string, capture string, responseChan chan utils.Event) (context.CancelFunc, error) {
+		return sm.SendMessage(model, conversation, prompt, filenames, capture, responseChan)
 	}
-	server.ConfigureGrokAPI(grokAPI, grokAPIUsingFile)
+	server.ConfigureGrokAPI(grokAPI, grokAPIWithFiles)
+	server.ConfigureIdleSessions(sm.Idle)
 	server.ConfigureExpectedAPIKey(token)
+	server.ConfigurePrivateMode(privateFlag)
+	server.ConfigureLocalImageDir(imageDir)
+	server.ConfigureJSONAttempts(jsonAttempts)
+	server.ConfigurePromptLength(promptLength)
+	server.ConfigureAttachmentSize(attachmentSize)
 	mux := http.NewServeMux()
 	chatCompletionHandler := http.HandlerFunc(server.ChatCompletionHandler)
 	listModelsHandler := http.HandlerFunc(server.ListModelsHandler)
-	mux.Handle("/v1/chat/completions", server.NeedAuthorization(chatCompletionHandler))
+	completionHandler := http.HandlerFunc(server.CompletionHandler)
+	messagesHandler := http.HandlerFunc(server.MessagesHandler)
+	responsesHandler := http.HandlerFunc(server.ResponsesHandler)
+	ollamaChatHandler := http.HandlerFunc(server.OllamaChatHandler)
+	ollamaGenerateHandler := http.HandlerFunc(server.OllamaGenerateHandler)
+	ollamaTagsHandler := http.HandlerFunc(server.OllamaTagsHandler)
+	mux.Handle("/v1/chat/completions", server.NeedAuthorization(server.WithRequestID(chatCompletionHandler)))
+	mux.Handle("/v1/completions", server.NeedAuthorization(server.WithRequestID(completionHandler)))
+	mux.Handle("/v1/messages", server.NeedAuthorization(server.WithRequestID(messagesHandler)))
+	mux.Handle("/v1/responses", server.NeedAuthorization(server.WithRequestID(responsesHandler)))
+	mux.Handle("/api/chat", server.NeedAuthorization(server.WithRequestID(ollamaChatHandler)))
+	mux.Handle("/api/generate", server.NeedAuthorization(server.WithRequestID(ollamaGenerateHandler)))
+	mux.Handle("/api/tags", server.NeedAuthorization(ollamaTagsHandler))
 	mux.Handle("/v1/models", server.NeedAuthorization(listModelsHandler))
+	mux.Handle("/admin/conversations", server.NeedAdmin(http.HandlerFunc(server.ConversationsHandler)))
+	mux.Handle("/admin/scratch", server.NeedAdmin(http.HandlerFunc(server.ScratchHandler)))
+	mux.Handle("/admin/requests", server.NeedAdmin(http.HandlerFunc(server.RequestsHandler)))
+	mux.Handle("/admin/requests/replay", server.NeedAdmin(http.HandlerFunc(server.ReplayHandler)))
+	server.ConfigureReplay(mux)
 	log.Printf("Starting server on port %d...\n", port)
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
@@ -71,3 +172,29 @@ func main() {
 		return
 	}
 }
+
+// replay asks the server running on port to replay an archived request and
+// copies the response to stdout.
+func replay(port int, token string, id string) error {
+	url := fmt.Sprintf("http://localhost:%d/admin/requests/replay?id=%s", port, neturl.QueryEscape(id))
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	log.Printf("Replayed as %s", resp.Header.Get("X-Request-Id"))
+	return nil
+}
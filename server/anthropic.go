@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MessagesHandler serves the Anthropic Messages API on top of the same sessions
+// as ChatCompletionHandler.
+func MessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, newAPIError("Only POST method is allowed", http.StatusMethodNotAllowed))
+		return
+	}
+	var request utils.AnthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errMsg := fmt.Sprintf("Failed to parse request body: %v", err)
+		writeAnthropicError(w, newAPIError(errMsg, http.StatusBadRequest))
+		log.Println(errMsg)
+		return
+	}
+	defer r.Body.Close()
+	messageID := fmt.Sprintf("msg_%d", time.Now().UnixNano())
+	modelName := request.Model
+	grokModel, apiErr := resolveModel(r, modelName, request.Grok)
+	if apiErr != nil {
+		writeAnthropicError(w, apiErr)
+		log.Println(apiErr)
+		return
+	}
+
+	mode, err := resolveReasoningMode(request.ReasoningMode)
+	if err != nil {
+		writeAnthropicError(w, newAPIError(err.Error(), http.StatusBadRequest))
+		log.Println(err)
+		return
+	}
+	if request.ThinkingEnabled() {
+		mode = ReasoningSeparate
+	}
+
+	msgs := request.ToMessages()
+	prefill := utils.Prefill(msgs)
+	prompt := messagePrompt(grokModel, append(msgs, utils.FormatPrefill(prefill)...))
+	promptTokens := utils.EstimateTokens(prompt.text)
+	responseChan, cancelFunc, err := askGrok(r.Context(), grokModel, nil, prompt, utils.MessageImages(msgs))
+	if err != nil {
+		writeAnthropicError(w, toAPIError(err))
+		log.Println(err)
+		return
+	}
+	defer cancelFunc()
+	limits := newOutputLimits(request.StopSequences, request.MaxTokens, prefill, cancelFunc)
+
+	if !request.Stream {
+		result := collect(responseChan, mode, nil, limits)
+		if result.content == "" && result.reasoning == "" && !result.cut {
+			apiErr := grokFailed(result.err)
+			writeAnthropicError(w, apiErr)
+			log.Println(apiErr)
+			return
+		}
+		usage := utils.AnthropicUsage{
+			InputTokens:  promptTokens,
+			OutputTokens: utils.EstimateTokens(result.content) + utils.EstimateTokens(result.reasoning),
+		}
+		finishReason, stopSequence := anthropicFinish(result.finishReason, limits)
+		writeJSON(w, utils.BuildAnthropicResponse(result.content, result.reasoning, messageID, modelName, finishReason, stopSequence, usage))
+		return
+	}
+
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+	processAnthropicStream(responseChan, messageID, modelName, mode, promptTokens, limits, w, flusher)
+}
+
+// processAnthropicStream forwards events as Anthropic SSE events, opening a
+// new content block whenever the output switches between thinking and text.
+func processAnthropicStream(responseChan chan utils.Event, messageID string, model string, mode string, promptTokens int, limits *outputLimits, w http.ResponseWriter, flusher http.Flusher) {
+	defer func() {
+		for range responseChan {
+		}
+	}()
+	if err := sendAnthropicEvent(w, flusher, utils.BuildAnthropicMessageStart(messageID, model, promptTokens)); err != nil {
+		log.Printf("Failed to send event: %v", err)
+		return
+	}
+	renderer := newRenderer(mode)
+	index := -1
+	blockType := ""
+	// the output is kept to estimate its tokens once, as the non-stream path does
+	var text, thinking strings.Builder
+	finishReason := "stop"
+	var grokErr error
+	send := func(delta string, deltaType string) error {
+		if delta == "" {
+			return nil
+		}
+		if deltaType == "thinking" {
+			thinking.WriteString(delta)
+		} else {
+			text.WriteString(delta)
+		}
+		if deltaType != blockType {
+			if blockType != "" {
+				if err := sendAnthropicEvent(w, flusher, utils.BuildAnthropicBlockStop(index)); err != nil {
+					return err
+				}
+			}
+			index++
+			blockType = deltaType
+			if err := sendAnthropicEvent(w, flusher, utils.BuildAnthropicBlockStart(index, blockType)); err != nil {
+				return err
+			}
+		}
+		return sendAnthropicEvent(w, flusher, utils.BuildAnthropicBlockDelta(index, blockType, delta))
+	}
+	for event := range responseChan {
+		if limits.done() {
+			continue
+		}
+		switch event.Type {
+		case utils.EventError:
+			grokErr = event.Err
+			continue
+		case utils.EventFinish:
+			finishReason = event.FinishReason
+			continue
+		case utils.EventMetadata:
+			continue
+		case utils.EventText:
+			event.Text = limits.text(event.Text)
+		}
+		content, reasoning := renderer.render(limits.take(event, mode != ReasoningNone))
+		if err := send(reasoning, "thinking"); err != nil {
+			log.Printf("Failed to send event: %v", err)
+			return
+		}
+		if err := send(content, "text"); err != nil {
+			log.Printf("Failed to send event: %v", err)
+			return
+		}
+	}
+	if text := limits.flush(); text != "" {
+		content, _ := renderer.render(limits.take(utils.TextEvent(text), false))
+		if err := send(content, "text"); err != nil {
+			log.Printf("Failed to send event: %v", err)
+			return
+		}
+	}
+	if err := send(renderer.flush(), "text"); err != nil {
+		log.Printf("Failed to send event: %v", err)
+		return
+	}
+	if grokErr != nil {
+		log.Printf("Grok response ended with error: %v", grokErr)
+		apiErr := toAPIError(grokErr)
+		if err := sendAnthropicEvent(w, flusher, utils.BuildAnthropicError(apiErr.anthropicType(), apiErr.message)); err != nil {
+			log.Printf("Failed to send event: %v", err)
+		}
+		return
+	}
+	if blockType == "" {
+		// a message always carries at least one content block
+		index = 0
+		if err := sendAnthropicEvent(w, flusher, utils.BuildAnthropicBlockStart(index, "text")); err != nil {
+			log.Printf("Failed to send event: %v", err)
+			return
+		}
+	}
+	finishReason, stopSequence := anthropicFinish(finishReason, limits)
+	outputTokens := utils.EstimateTokens(text.String()) + utils.EstimateTokens(thinking.String())
+	events := []*utils.AnthropicStreamEvent{
+		utils.BuildAnthropicBlockStop(index),
+		utils.BuildAnthropicMessageDelta(finishReason, stopSequence, outputTokens),
+		utils.BuildAnthropicMessageStop(),
+	}
+	for _, event := range events {
+		if err := sendAnthropicEvent(w, flusher, event); err != nil {
+			log.Printf("Failed to send event: %v", err)
+			return
+		}
+	}
+	log.Println("Finished sending response")
+}
+
+// anthropicFinish returns the finish reason of an answer, telling a cut at a
+// stop sequence apart from Grok ending it, and the stop sequence.
+func anthropicFinish(finishReason string, limits *outputLimits) (string, string) {
+	if stop := limits.stopSequence(); stop != "" {
+		return "stop_sequence", stop
+	}
+	return limits.finishReason(finishReason), ""
+}
+
+func sendAnthropicEvent(w http.ResponseWriter, flusher http.Flusher, event *utils.AnthropicStreamEvent) error {
+	eventData, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, eventData); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"grok-chat-proxy2/client"
+	"grok-chat-proxy2/utils"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMessagesHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []utils.Event
+		body   string
+		status int
+		want   []string
+	}{
+		{
+			name:   "answer",
+			events: answer,
+			body:   `{"model":"grok-3","max_tokens":100,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"type":"message"`, `\u003cthink\u003e\nThinking it over.\n\u003c/think\u003e\nHello there!"`, `"stop_reason":"end_turn"`},
+		},
+		{
+			name:   "thinking",
+			events: answer,
+			body:   `{"model":"grok-3","max_tokens":100,"thinking":{"type":"enabled","budget_tokens":50},"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"thinking":"Thinking it over."`, `"text":"Hello there!"`},
+		},
+		{
+			name:   "stream",
+			events: answer,
+			body:   `{"model":"grok-3","max_tokens":100,"stream":true,"thinking":{"type":"enabled","budget_tokens":50},"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{"event: message_start", `"type":"thinking_delta","thinking":"Thinking it over."`, `"type":"text_delta","text":"Hello"`, `"stop_reason":"end_turn"`, "event: message_stop"},
+		},
+		{
+			name:   "max_tokens",
+			events: answer,
+			body:   `{"model":"grok-3","max_tokens":1,"reasoning_mode":"none","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"text":"Hello"`, `"stop_reason":"max_tokens"`},
+		},
+		{
+			name:   "stop sequence",
+			events: answer,
+			body:   `{"model":"grok-3","max_tokens":100,"stop_sequences":["!"],"reasoning_mode":"none","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"text":"Hello there"`, `"stop_reason":"stop_sequence"`, `"stop_sequence":"!"`},
+		},
+		{
+			name:   "empty answer",
+			events: []utils.Event{utils.FinishEvent("stop")},
+			body:   `{"model":"grok-3","max_tokens":100,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusBadGateway,
+			want:   []string{`"type":"api_error"`},
+		},
+		{
+			name:   "rate limited",
+			events: []utils.Event{utils.ErrorEvent(client.ErrRateLimited)},
+			body:   `{"model":"grok-3","max_tokens":100,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusTooManyRequests,
+			want:   []string{`"type":"rate_limit_error"`},
+		},
+		{
+			name:   "unknown model",
+			body:   `{"model":"claude-0","max_tokens":100,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusBadRequest,
+			want:   []string{`"type":"invalid_request_error"`, "Unsupported model: claude-0"},
+		},
+		{
+			name:   "invalid body",
+			body:   `{"model":`,
+			status: http.StatusBadRequest,
+			want:   []string{`"type":"invalid_request_error"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestGrok(t, tt.events...)
+			rec := serve(MessagesHandler, http.MethodPost, "/v1/messages", tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("missing %s in:\n%s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestMessagesHandlerPrompt(t *testing.T) {
+	grok := useTestGrok(t, answer...)
+	rec := serve(MessagesHandler, http.MethodPost, "/v1/messages", `{"model":"grok-3","max_tokens":100,"system":[{"type":"text","text":"Be brief."}],"messages":[{"role":"user","content":[{"type":"text","text":"Hi"}]}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if prompt := grok.lastPrompt(); !strings.Contains(prompt, "system: Be brief.") || !strings.Contains(prompt, "human: Hi") {
+		t.Errorf("unexpected prompt %q", prompt)
+	}
+}
+
+func TestMessagesHandlerMethod(t *testing.T) {
+	rec := serve(MessagesHandler, http.MethodGet, "/v1/messages", "")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if !strings.Contains(rec.Body.String(), `"type":"error"`) {
+		t.Errorf("not an Anthropic error: %s", rec.Body.String())
+	}
+}
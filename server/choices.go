@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"grok-chat-proxy2/utils"
+	"log"
+)
+
+var idleSessions func() int
+
+// ConfigureIdleSessions tells the server how many sessions are free, which
+// bounds how many choices a request with n > 1 can get.
+func ConfigureIdleSessions(idle func() int) {
+	idleSessions = idle
+}
+
+// grokChoice is one answer being generated for a request.
+type grokChoice struct {
+	responseChan chan utils.Event
+	cancel       context.CancelFunc
+}
+
+// askGrokChoices sends the prompt to up to n sessions, one per choice, so the
+// answers are generated side by side. The first choice waits for a session
+// like any request. The others only take sessions that are idle at the time,
+// so a busy pool returns fewer choices than asked for rather than making the
+// request wait on itself. The returned cancel function cancels all choices.
+func askGrokChoices(ctx context.Context, model utils.Model, prompt grokPrompt, images []string, n int) ([]grokChoice, context.CancelFunc, error) {
+	responseChan, cancelFunc, err := askGrok(ctx, model, nil, prompt, images)
+	if err != nil {
+		return nil, nil, err
+	}
+	choices := []grokChoice{{responseChan: responseChan, cancel: cancelFunc}}
+	for len(choices) < n && idleSessions != nil && idleSessions() > 0 {
+		responseChan, cancelFunc, err := askGrok(ctx, model, nil, prompt, images)
+		if err != nil {
+			log.Printf("Failed to start choice %d: %v", len(choices), err)
+			break
+		}
+		choices = append(choices, grokChoice{responseChan: responseChan, cancel: cancelFunc})
+	}
+	if len(choices) < n {
+		log.Printf("Requested %d choices, only %d sessions were available", n, len(choices))
+	}
+	return choices, func() {
+		for _, choice := range choices {
+			choice.cancel()
+		}
+	}, nil
+}
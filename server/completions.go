@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CompletionHandler serves the legacy text completions API. The prompt is sent
+// to Grok verbatim, without the prompt template of the model.
+func CompletionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request utils.OpenAICompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errMsg := fmt.Sprintf("Failed to parse request body: %v", err)
+		writeError(w, errMsg, http.StatusBadRequest)
+		log.Println(errMsg)
+		return
+	}
+	defer r.Body.Close()
+	requestID := fmt.Sprintf("cmpl-%d", time.Now().UnixNano())
+	modelName := request.Model
+	grokModel, apiErr := resolveModel(r, modelName, request.Grok)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		log.Println(apiErr)
+		return
+	}
+	mode, err := resolveReasoningMode(request.ReasoningMode)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	prompt := string(request.Prompt)
+	opts := chatOptions{
+		requestID:    requestID,
+		model:        modelName,
+		mode:         mode,
+		promptTokens: utils.EstimateTokens(prompt),
+		includeUsage: request.StreamOptions.Usage(),
+	}
+	responseChan, cancelFunc, err := askGrok(r.Context(), grokModel, nil, rawPrompt(prompt), nil)
+	if err != nil {
+		writeAPIError(w, toAPIError(err))
+		log.Println(err)
+		return
+	}
+	defer cancelFunc()
+
+	limits := newOutputLimits(request.Stop, request.MaxTokens, "", cancelFunc)
+	if !request.Stream {
+		result := collectCompletion(responseChan, mode, limits)
+		if result.content == "" && !result.cut {
+			apiErr := grokFailed(result.err)
+			writeAPIError(w, apiErr)
+			log.Println(apiErr)
+			return
+		}
+		usage := chatUsage(opts.promptTokens, mode, result.content, nil, result.reasoningTokens)
+		text := result.content
+		if request.Echo {
+			text = prompt + text
+		}
+		writeJSON(w, utils.BuildCompletionResponse(text, requestID, modelName, result.finishReason, usage))
+		return
+	}
+
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+	echo := ""
+	if request.Echo {
+		echo = prompt
+	}
+	processCompletionStream(responseChan, opts, echo, limits, w, flusher)
+}
+
+// collectCompletion drains responseChan into the completion text. Reasoning is
+// only kept in inline mode since the API has nowhere else to put it.
+func collectCompletion(responseChan chan utils.Event, mode string, limits *outputLimits) result {
+	renderer := newRenderer(mode)
+	var text strings.Builder
+	res := result{finishReason: "stop", mode: mode}
+	for event := range responseChan {
+		if limits.done() {
+			continue
+		}
+		switch event.Type {
+		case utils.EventError:
+			res.err = event.Err
+			continue
+		case utils.EventFinish:
+			res.finishReason = event.FinishReason
+			continue
+		}
+		if event.Type == utils.EventText {
+			event.Text = limits.text(event.Text)
+		}
+		content, _ := renderer.render(limits.take(event, mode == ReasoningInline))
+		text.WriteString(content)
+	}
+	if tail := limits.flush(); tail != "" {
+		content, _ := renderer.render(limits.take(utils.TextEvent(tail), false))
+		text.WriteString(content)
+	}
+	text.WriteString(renderer.flush())
+	res.content = text.String()
+	res.reasoningTokens = renderer.reasoningTokens()
+	res.cut = limits.done()
+	res.finishReason = limits.finishReason(res.finishReason)
+	return res
+}
+
+func processCompletionStream(responseChan chan utils.Event, opts chatOptions, echo string, limits *outputLimits, w http.ResponseWriter, flusher http.Flusher) {
+	defer func() {
+		for range responseChan {
+		}
+	}()
+	requestID, model := opts.requestID, opts.model
+	renderer := newRenderer(opts.mode)
+	var text strings.Builder
+	sent := false
+	finishReason := "stop"
+	var grokErr error
+	send := func(delta string) error {
+		if delta == "" {
+			return nil
+		}
+		sent = true
+		text.WriteString(delta)
+		return sendCompletionChunk(w, flusher, utils.BuildCompletionChunk(delta, requestID, model))
+	}
+	if err := send(echo); err != nil {
+		log.Printf("Failed to send chunk: %v", err)
+		return
+	}
+	for event := range responseChan {
+		if limits.done() {
+			continue
+		}
+		switch event.Type {
+		case utils.EventError:
+			grokErr = event.Err
+			continue
+		case utils.EventFinish:
+			finishReason = event.FinishReason
+			continue
+		}
+		if event.Type == utils.EventText {
+			event.Text = limits.text(event.Text)
+		}
+		content, _ := renderer.render(limits.take(event, opts.mode == ReasoningInline))
+		if err := send(content); err != nil {
+			log.Printf("Failed to send chunk: %v", err)
+			return
+		}
+	}
+	if tail := limits.flush(); tail != "" {
+		content, _ := renderer.render(limits.take(utils.TextEvent(tail), false))
+		if err := send(content); err != nil {
+			log.Printf("Failed to send chunk: %v", err)
+			return
+		}
+	}
+	if err := send(renderer.flush()); err != nil {
+		log.Printf("Failed to send chunk: %v", err)
+		return
+	}
+	finishReason = limits.finishReason(finishReason)
+	if grokErr != nil {
+		log.Printf("Grok response ended with error: %v", grokErr)
+		if !sent && !limits.done() {
+			writeAPIError(w, grokFailed(grokErr))
+		} else if err := sendStreamError(w, flusher, toAPIError(grokErr)); err != nil {
+			log.Printf("Failed to send chunk: %v", err)
+		}
+		return
+	}
+	if err := sendCompletionChunk(w, flusher, utils.BuildCompletionFinish(requestID, model, finishReason)); err != nil {
+		log.Printf("Failed to send chunk: %v", err)
+		return
+	}
+	if opts.includeUsage {
+		// the echoed prompt is not part of the completion
+		completion := strings.TrimPrefix(text.String(), echo)
+		usage := chatUsage(opts.promptTokens, opts.mode, completion, nil, renderer.reasoningTokens())
+		if err := sendCompletionChunk(w, flusher, utils.BuildCompletionUsage(requestID, model, usage)); err != nil {
+			log.Printf("Failed to send chunk: %v", err)
+			return
+		}
+	}
+	if err := endStream(w, flusher); err != nil {
+		log.Printf("Failed to send chunk: %v", err)
+		return
+	}
+	log.Println("Finished sending response")
+}
+
+func sendCompletionChunk(w http.ResponseWriter, flusher http.Flusher, chunk *utils.OpenAICompletionResponse) error {
+	chunkData, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", chunkData); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
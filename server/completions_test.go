@@ -0,0 +1,114 @@
+package server
+
+import (
+	"grok-chat-proxy2/client"
+	"grok-chat-proxy2/utils"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompletionHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []utils.Event
+		body   string
+		status int
+		want   []string
+	}{
+		{
+			name:   "answer",
+			events: answer,
+			body:   `{"model":"grok-3","reasoning_mode":"none","prompt":"Say:"}`,
+			status: http.StatusOK,
+			want:   []string{`"object":"text_completion"`, `"text":"Hello there!"`, `"finish_reason":"stop"`},
+		},
+		{
+			name:   "echo",
+			events: answer,
+			body:   `{"model":"grok-3","reasoning_mode":"none","echo":true,"prompt":["Say:"]}`,
+			status: http.StatusOK,
+			want:   []string{`"text":"Say:Hello there!"`},
+		},
+		{
+			name:   "stream",
+			events: answer,
+			body:   `{"model":"grok-3","reasoning_mode":"none","stream":true,"stream_options":{"include_usage":true},"prompt":"Say:"}`,
+			status: http.StatusOK,
+			want:   []string{`"text":"Hello"`, `"text":" there!"`, `"finish_reason":"stop"`, `"usage":{`, "data: [DONE]"},
+		},
+		{
+			name:   "max_tokens",
+			events: answer,
+			body:   `{"model":"grok-3","reasoning_mode":"none","max_tokens":1,"prompt":"Say:"}`,
+			status: http.StatusOK,
+			want:   []string{`"text":"Hello"`, `"finish_reason":"length"`},
+		},
+		{
+			name:   "stop sequence",
+			events: answer,
+			body:   `{"model":"grok-3","reasoning_mode":"none","stop":["!"],"prompt":"Say:"}`,
+			status: http.StatusOK,
+			want:   []string{`"text":"Hello there"`, `"finish_reason":"stop"`},
+		},
+		{
+			name:   "stop at the start",
+			events: answer,
+			body:   `{"model":"grok-3","reasoning_mode":"none","stop":["Hello"],"prompt":"Say:"}`,
+			status: http.StatusOK,
+			want:   []string{`"text":""`, `"finish_reason":"stop"`},
+		},
+		{
+			name:   "only reasoning",
+			events: []utils.Event{utils.ReasoningEvent("Thinking it over."), utils.FinishEvent("stop")},
+			body:   `{"model":"grok-3","reasoning_mode":"none","prompt":"Say:"}`,
+			status: http.StatusBadGateway,
+			want:   []string{`"code":"upstream_error"`},
+		},
+		{
+			name:   "rate limited",
+			events: []utils.Event{utils.ErrorEvent(client.ErrRateLimited)},
+			body:   `{"model":"grok-3","prompt":"Say:"}`,
+			status: http.StatusTooManyRequests,
+			want:   []string{`"code":"rate_limit_exceeded"`},
+		},
+		{
+			name:   "unknown model",
+			body:   `{"model":"davinci","prompt":"Say:"}`,
+			status: http.StatusBadRequest,
+			want:   []string{"Unsupported model: davinci"},
+		},
+		{
+			name:   "invalid body",
+			body:   `{"model":`,
+			status: http.StatusBadRequest,
+			want:   []string{`"type":"invalid_request_error"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestGrok(t, tt.events...)
+			rec := serve(CompletionHandler, http.MethodPost, "/v1/completions", tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("missing %s in:\n%s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestCompletionHandlerPrompt(t *testing.T) {
+	grok := useTestGrok(t, answer...)
+	rec := serve(CompletionHandler, http.MethodPost, "/v1/completions", `{"model":"grok-3","prompt":"Once upon a time"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	// the prompt is sent as it is, without any template around it
+	if prompt := grok.lastPrompt(); prompt != "Once upon a time" {
+		t.Errorf("got prompt %q", prompt)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"grok-chat-proxy2/client"
+	"grok-chat-proxy2/utils"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conversationStore remembers which Grok conversation each answered message
+// list is in, keyed by a hash of the model, the API key, the messages and the
+// answer, so that a request of the same caller extending the list with a new
+// user turn can continue there. When it has a path, the entries are kept on
+// disk across restarts.
+type conversationStore struct {
+	mu      sync.Mutex
+	entries map[string]conversationEntry
+	// claimed are the entries being continued by a request right now
+	claimed map[string]bool
+	// path is the JSON file the entries are saved to, none when empty
+	path string
+	// ttl is how long an answered message list can be continued
+	ttl time.Duration
+}
+
+// conversationEntry is where an answered message list ended up on Grok.
+type conversationEntry struct {
+	Hash           string `json:"hash"`
+	Session        int    `json:"session"`
+	ConversationID string `json:"conversation_id"`
+	ResponseID     string `json:"response_id,omitempty"`
+	Model          string `json:"model"`
+	// Messages counts the messages hashed, the answer included
+	Messages int `json:"messages"`
+	// Created is when the Grok conversation was started
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func (e conversationEntry) conversation() utils.Conversation {
+	return utils.Conversation{Session: e.Session, ConversationID: e.ConversationID, ResponseID: e.ResponseID}
+}
+
+var conversations = &conversationStore{entries: make(map[string]conversationEntry), claimed: make(map[string]bool), ttl: 24 * time.Hour}
+
+// ConfigureConversationStore loads the conversations saved at path, and
+// saves them there from now on. Conversations not continued within ttl are
+// forgotten.
+func ConfigureConversationStore(path string, ttl time.Duration) error {
+	conversations.mu.Lock()
+	defer conversations.mu.Unlock()
+	conversations.path = path
+	conversations.ttl = ttl
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []conversationEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	for _, entry := range entries {
+		conversations.entries[entry.Hash] = entry
+	}
+	conversations.expire()
+	log.Printf("Loaded %d conversations from %s", len(conversations.entries), path)
+	return nil
+}
+
+// reasoningBlocks matches the reasoning rendered inline, which clients may
+// or may not send back with the answer.
+var reasoningBlocks = regexp.MustCompile(`(?s)<(think|research)>.*?</(think|research)>`)
+
+type keyedMessage struct {
+	Role   string   `json:"role"`
+	Text   string   `json:"text"`
+	Images []string `json:"images,omitempty"`
+}
+
+// conversationKey hashes what Grok has seen of the messages, along with the
+// model and the API key, so that a conversation is only continued on the
+// model it was started on and by the caller who started it.
+func conversationKey(model string, apiKey string, msgs []utils.Message) string {
+	keyed := make([]keyedMessage, len(msgs))
+	for i, msg := range msgs {
+		text := msg.Content.Text()
+		if msg.Role == "assistant" {
+			text = reasoningBlocks.ReplaceAllString(text, "")
+		}
+		keyed[i] = keyedMessage{Role: msg.Role, Text: strings.TrimSpace(text), Images: msg.Content.Images()}
+	}
+	data, _ := json.Marshal(struct {
+		Model    string         `json:"model"`
+		Key      string         `json:"key"`
+		Messages []keyedMessage `json:"messages"`
+	}{model, apiKey, keyed})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// take returns the conversation that msgs, ending with a new user turn,
+// continue on the model for the API key. The entry is claimed until save
+// replaces it or release gives it back, so that the same messages sent again
+// meanwhile start over in a new chat instead of adding to the old one twice.
+func (s *conversationStore) take(model string, apiKey string, msgs []utils.Message) (conversationEntry, bool) {
+	if len(msgs) < 2 || msgs[len(msgs)-1].Role != "user" || msgs[len(msgs)-2].Role != "assistant" {
+		return conversationEntry{}, false
+	}
+	key := conversationKey(model, apiKey, msgs[:len(msgs)-1])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || s.claimed[key] {
+		return conversationEntry{}, false
+	}
+	if s.expired(entry) {
+		delete(s.entries, key)
+		s.persist()
+		return conversationEntry{}, false
+	}
+	s.claimed[key] = true
+	return entry, true
+}
+
+// release gives back an entry taken by a request that did not get an answer
+// to save, so that it can be continued again.
+func (s *conversationStore) release(entry *conversationEntry) {
+	if entry == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.claimed, entry.Hash)
+}
+
+// save remembers the conversation that msgs were answered in, on the model
+// for the API key. continued is the entry the request continued, if any,
+// which the new one replaces.
+func (s *conversationStore) save(msgs []utils.Message, answer string, model string, apiKey string, conversation utils.Conversation, continued *conversationEntry) {
+	now := time.Now()
+	entry := conversationEntry{
+		Session:        conversation.Session,
+		ConversationID: conversation.ConversationID,
+		ResponseID:     conversation.ResponseID,
+		Model:          model,
+		Messages:       len(msgs) + 1,
+		Created:        now,
+		Updated:        now,
+	}
+	if continued != nil {
+		entry.Session = continued.Session
+		entry.Created = continued.Created
+		if entry.ConversationID == "" {
+			entry.ConversationID = continued.ConversationID
+		}
+	}
+	if entry.ConversationID == "" {
+		return
+	}
+	answered := append(msgs[:len(msgs):len(msgs)], utils.Message{Role: "assistant", Content: utils.TextContent(answer)})
+	entry.Hash = conversationKey(model, apiKey, answered)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	if continued != nil {
+		delete(s.entries, continued.Hash)
+		delete(s.claimed, continued.Hash)
+	}
+	s.entries[entry.Hash] = entry
+	s.persist()
+}
+
+func (s *conversationStore) expired(entry conversationEntry) bool {
+	return time.Since(entry.Updated) > s.ttl
+}
+
+// expire drops the entries past their ttl. The caller holds the lock.
+func (s *conversationStore) expire() {
+	for key, entry := range s.entries {
+		if s.expired(entry) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// list returns the entries matching the filters, newest first. Empty filters
+// match everything.
+func (s *conversationStore) list(hash string, conversationID string) []conversationEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	entries := []conversationEntry{}
+	for _, entry := range s.entries {
+		if (hash == "" || entry.Hash == hash) && (conversationID == "" || entry.ConversationID == conversationID) {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b conversationEntry) int {
+		return b.Updated.Compare(a.Updated)
+	})
+	return entries
+}
+
+// remove deletes the entries matching the filters and returns how many there
+// were.
+func (s *conversationStore) remove(hash string, conversationID string) int {
+	entries := s.list(hash, conversationID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range entries {
+		delete(s.entries, entry.Hash)
+	}
+	s.persist()
+	return len(entries)
+}
+
+// persist writes the entries to disk. The caller holds the lock.
+func (s *conversationStore) persist() {
+	if s.path == "" {
+		return
+	}
+	entries := make([]conversationEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		log.Printf("Failed to marshal conversations: %v", err)
+		return
+	}
+	if err := utils.WriteFileAtomic(s.path, data); err != nil {
+		log.Printf("Failed to save conversations: %v", err)
+	}
+}
+
+// askGrokContinuing posts only the last user turn into the conversation the
+// messages continue, if there is one. Otherwise, or when the session owning
+// that conversation stays busy, the whole prompt is sent in a new chat. The
+// entry of the continued conversation is returned, nil for a new chat.
+func askGrokContinuing(ctx context.Context, model utils.Model, apiKey string, msgs []utils.Message, prompt grokPrompt, images []string) (chan utils.Event, context.CancelFunc, *conversationEntry, error) {
+	if entry, ok := conversations.take(model.ID, apiKey, msgs); ok {
+		turn := msgs[len(msgs)-1:]
+		conversation := entry.conversation()
+		responseChan, cancelFunc, err := askGrok(ctx, model, &conversation, messagePrompt(model, turn), utils.MessageImages(turn))
+		if err == nil {
+			log.Printf("Continuing Grok conversation %s on session %d", entry.ConversationID, entry.Session)
+			return responseChan, cancelFunc, &entry, nil
+		}
+		conversations.release(&entry)
+		if !errors.Is(err, client.ErrConversationBusy) {
+			return nil, nil, nil, err
+		}
+		log.Printf("Starting a new chat instead: %v", err)
+	}
+	responseChan, cancelFunc, err := askGrok(ctx, model, nil, prompt, images)
+	return responseChan, cancelFunc, nil, err
+}
+
+// ConversationsHandler lists the remembered conversations on GET and forgets
+// them on DELETE. Both take hash and conversation_id query parameters to
+// select entries, DELETE requires one of them.
+func ConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("hash")
+	conversationID := r.URL.Query().Get("conversation_id")
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]any{"conversations": conversations.list(hash, conversationID)})
+	case http.MethodDelete:
+		if hash == "" && conversationID == "" {
+			writeError(w, "hash or conversation_id is required", http.StatusBadRequest)
+			return
+		}
+		deleted := conversations.remove(hash, conversationID)
+		log.Printf("Deleted %d conversations", deleted)
+		writeJSON(w, map[string]int{"deleted": deleted})
+	default:
+		writeError(w, "Only GET and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
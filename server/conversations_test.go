@@ -0,0 +1,135 @@
+package server
+
+import (
+	"grok-chat-proxy2/utils"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestConversationStore(ttl time.Duration) *conversationStore {
+	return &conversationStore{entries: map[string]conversationEntry{}, claimed: map[string]bool{}, ttl: ttl}
+}
+
+func textMessage(role string, text string) utils.Message {
+	return utils.Message{Role: role, Content: utils.TextContent(text)}
+}
+
+func TestConversationStore(t *testing.T) {
+	first := []utils.Message{textMessage("user", "Hi")}
+	next := append(first[:1:1], textMessage("assistant", "Hello!"), textMessage("user", "How are you?"))
+	grok := utils.Conversation{Session: 2, ConversationID: "conv-1", ResponseID: "resp-1"}
+
+	tests := []struct {
+		name   string
+		model  string
+		apiKey string
+		msgs   []utils.Message
+		want   bool
+	}{
+		{"same model and key", "grok-3", "key", next, true},
+		{"other model", "grok-4", "key", next, false},
+		{"other key", "grok-3", "other", next, false},
+		{"other answer", "grok-3", "key", append(first[:1:1], textMessage("assistant", "Hey!"), textMessage("user", "How are you?")), false},
+		{"not ending with a user turn", "grok-3", "key", next[:2], false},
+		{"inline reasoning is ignored", "grok-3", "key", append(first[:1:1], textMessage("assistant", "<think>hm</think>Hello!"), textMessage("user", "More")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestConversationStore(time.Hour)
+			s.save(first, "Hello!", "grok-3", "key", grok, nil)
+			entry, ok := s.take(tt.model, tt.apiKey, tt.msgs)
+			if ok != tt.want {
+				t.Fatalf("take found %v, want %v", ok, tt.want)
+			}
+			if ok && entry.conversation() != grok {
+				t.Errorf("got conversation %+v, want %+v", entry.conversation(), grok)
+			}
+		})
+	}
+}
+
+func TestConversationStoreClaims(t *testing.T) {
+	s := newTestConversationStore(time.Hour)
+	first := []utils.Message{textMessage("user", "Hi")}
+	next := append(first[:1:1], textMessage("assistant", "Hello!"), textMessage("user", "Again"))
+	s.save(first, "Hello!", "m", "", utils.Conversation{Session: 1, ConversationID: "c"}, nil)
+
+	entry, ok := s.take("m", "", next)
+	if !ok {
+		t.Fatal("the saved conversation was not found")
+	}
+	if _, ok := s.take("m", "", next); ok {
+		t.Error("a claimed conversation was taken twice")
+	}
+	s.release(&entry)
+	entry, ok = s.take("m", "", next)
+	if !ok {
+		t.Fatal("a released conversation could not be taken again")
+	}
+
+	// saving the answer replaces the continued entry, in the same session
+	s.save(next, "Fine.", "m", "", utils.Conversation{Session: 9, ResponseID: "r2"}, &entry)
+	if _, ok := s.take("m", "", next); ok {
+		t.Error("the continued entry is still there")
+	}
+	latest, ok := s.take("m", "", append(next[:3:3], textMessage("assistant", "Fine."), textMessage("user", "Bye")))
+	if !ok {
+		t.Fatal("the new entry was not saved")
+	}
+	if latest.Session != 1 || latest.ConversationID != "c" || latest.ResponseID != "r2" || latest.Created != entry.Created || latest.Messages != 4 {
+		t.Errorf("unexpected entry %+v", latest)
+	}
+	if len(s.claimed) != 1 {
+		t.Errorf("%d claims left, want the one just taken", len(s.claimed))
+	}
+}
+
+func TestConversationStoreExpiry(t *testing.T) {
+	s := newTestConversationStore(time.Hour)
+	first := []utils.Message{textMessage("user", "Hi")}
+	s.save(first, "Hello!", "m", "", utils.Conversation{ConversationID: "c"}, nil)
+	for key, entry := range s.entries {
+		entry.Updated = time.Now().Add(-2 * time.Hour)
+		s.entries[key] = entry
+	}
+	if _, ok := s.take("m", "", append(first[:1:1], textMessage("assistant", "Hello!"), textMessage("user", "Again"))); ok {
+		t.Error("an expired conversation was continued")
+	}
+	if len(s.entries) != 0 {
+		t.Errorf("%d entries left after expiry", len(s.entries))
+	}
+}
+
+func TestConversationStoreSkipsAnswersWithoutConversation(t *testing.T) {
+	s := newTestConversationStore(time.Hour)
+	s.save([]utils.Message{textMessage("user", "Hi")}, "Hello!", "m", "", utils.Conversation{}, nil)
+	if len(s.entries) != 0 {
+		t.Error("an answer without a Grok conversation was remembered")
+	}
+}
+
+func TestConversationStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.json")
+	saved := conversations
+	defer func() { conversations = saved }()
+
+	conversations = newTestConversationStore(time.Hour)
+	if err := ConfigureConversationStore(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	first := []utils.Message{textMessage("user", "Hi")}
+	conversations.save(first, "Hello!", "m", "k", utils.Conversation{Session: 3, ConversationID: "c"}, nil)
+
+	conversations = newTestConversationStore(time.Hour)
+	if err := ConfigureConversationStore(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := conversations.take("m", "k", append(first[:1:1], textMessage("assistant", "Hello!"), textMessage("user", "Again")))
+	if !ok || entry.Session != 3 || entry.ConversationID != "c" {
+		t.Errorf("got %+v, %v after reloading", entry, ok)
+	}
+	if deleted := conversations.remove("", "c"); deleted != 1 {
+		t.Errorf("removed %d entries, want 1", deleted)
+	}
+}
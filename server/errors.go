@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"grok-chat-proxy2/client"
+	"grok-chat-proxy2/utils"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// apiError is an error together with what the client should be told: the
+// HTTP status and the OpenAI error type and code.
+type apiError struct {
+	status  int
+	errType string
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// newAPIError builds an error whose type follows from the status.
+func newAPIError(message string, status int) *apiError {
+	errType := "server_error"
+	switch {
+	case status == http.StatusUnauthorized:
+		errType = "authentication_error"
+	case status == http.StatusForbidden:
+		errType = "permission_error"
+	case status == http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case status < 500:
+		errType = "invalid_request_error"
+	}
+	return &apiError{status: status, errType: errType, message: message}
+}
+
+// grokFailures maps the client errors to what the client is told about them.
+var grokFailures = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{client.ErrQueueTimeout, http.StatusTooManyRequests, "sessions_busy"},
+	{client.ErrConversationBusy, http.StatusTooManyRequests, "sessions_busy"},
+	{client.ErrRateLimited, http.StatusTooManyRequests, "rate_limit_exceeded"},
+	{client.ErrNoSession, http.StatusServiceUnavailable, "no_session"},
+	{client.ErrLoggedOut, http.StatusServiceUnavailable, "session_logged_out"},
+	{client.ErrChallenge, http.StatusServiceUnavailable, "challenge_page"},
+	{client.ErrUpstream, http.StatusBadGateway, "upstream_error"},
+}
+
+// toAPIError describes any error met while serving a request. Errors that are
+// not already an *apiError are taken as failures of Grok.
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	for _, failure := range grokFailures {
+		if errors.Is(err, failure.err) {
+			apiErr = newAPIError(err.Error(), failure.status)
+			apiErr.code = failure.code
+			return apiErr
+		}
+	}
+	apiErr = newAPIError(err.Error(), http.StatusBadGateway)
+	apiErr.code = "upstream_error"
+	return apiErr
+}
+
+// grokFailed describes a response Grok did not deliver, err being the cause
+// if one is known.
+func grokFailed(err error) *apiError {
+	if err == nil {
+		err = errors.New("empty response")
+	}
+	apiErr := *toAPIError(err)
+	apiErr.message = fmt.Sprintf("Failed getting response from Grok: %s", apiErr.message)
+	return &apiErr
+}
+
+func (e *apiError) openAI() *utils.OpenAIError {
+	return utils.BuildOpenAIError(e.message, e.errType, e.code)
+}
+
+// anthropicType is the Anthropic error type matching the status.
+func (e *apiError) anthropicType() string {
+	switch {
+	case e.status == http.StatusUnauthorized:
+		return "authentication_error"
+	case e.status == http.StatusForbidden:
+		return "permission_error"
+	case e.status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case e.status < 500:
+		return "invalid_request_error"
+	}
+	return "api_error"
+}
+
+// writeError sends an OpenAI error object, in place of http.Error.
+func writeError(w http.ResponseWriter, message string, status int) {
+	writeAPIError(w, newAPIError(message, status))
+}
+
+func writeAPIError(w http.ResponseWriter, apiErr *apiError) {
+	writeErrorBody(w, apiErr.status, apiErr.openAI())
+}
+
+func writeAnthropicError(w http.ResponseWriter, apiErr *apiError) {
+	writeErrorBody(w, apiErr.status, utils.BuildAnthropicError(apiErr.anthropicType(), apiErr.message))
+}
+
+func writeOllamaError(w http.ResponseWriter, apiErr *apiError) {
+	writeErrorBody(w, apiErr.status, utils.OllamaError{Error: apiErr.message})
+}
+
+// writeErrorFor sends the error in the format of the API the request is for.
+func writeErrorFor(w http.ResponseWriter, r *http.Request, apiErr *apiError) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		writeOllamaError(w, apiErr)
+	case r.URL.Path == "/v1/messages":
+		writeAnthropicError(w, apiErr)
+	default:
+		writeAPIError(w, apiErr)
+	}
+}
+
+func writeErrorBody(w http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Failed to marshal error: %v", err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// sendStreamError reports a failure in band once an SSE stream has started,
+// since the status can no longer change.
+func sendStreamError(w http.ResponseWriter, flusher http.Flusher, apiErr *apiError) error {
+	data, err := json.Marshal(apiErr.openAI())
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"net/http"
+)
+
+var defaultPrivate bool
+var apiKeys = map[string]utils.APIKey{}
+
+// ConfigurePrivateMode sets whether chats are private unless the model or the
+// request says otherwise.
+func ConfigurePrivateMode(private bool) {
+	defaultPrivate = private
+}
+
+// ConfigureAPIKeys adds API keys with their own policy of which grok options
+// they may set. The key set with ConfigureExpectedAPIKey may set all of them.
+func ConfigureAPIKeys(keys []utils.APIKey) {
+	for _, key := range keys {
+		apiKeys[key.Key] = key
+	}
+}
+
+type apiKeyContextKey struct{}
+
+// withAPIKey records the key the request was authorized with.
+func withAPIKey(r *http.Request, key utils.APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+}
+
+// requestAPIKey returns the key the request was authorized with. Without
+// authentication every request may set all grok options.
+func requestAPIKey(r *http.Request) utils.APIKey {
+	if key, ok := r.Context().Value(apiKeyContextKey{}).(utils.APIKey); ok {
+		return key
+	}
+	return utils.APIKey{Allow: []string{"*"}}
+}
+
+// NeedAdmin lets through the requests NeedAuthorization does, except those
+// made with a key from ConfigureAPIKeys, which is only for the APIs.
+func NeedAdmin(next http.Handler) http.Handler {
+	return NeedAuthorization(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(apiKeyContextKey{}).(utils.APIKey); ok {
+			writeError(w, "This API key may not use the admin endpoints", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// resolveModel finds the requested model and applies the grok options of the
+// request, as far as the caller's API key allows them. The key's prompt
+// template replaces the model's.
+func resolveModel(r *http.Request, name string, options *utils.GrokOptions) (utils.Model, *apiError) {
+	model, ok := models.Lookup(name)
+	if !ok {
+		return model, newAPIError(fmt.Sprintf("Unsupported model: %s", name), http.StatusBadRequest)
+	}
+	model.Private = model.Private || defaultPrivate
+	key := requestAPIKey(r)
+	for _, option := range options.Overrides() {
+		if !key.Allows(option) {
+			apiErr := newAPIError(fmt.Sprintf("This API key may not set grok.%s", option), http.StatusForbidden)
+			apiErr.code = "option_not_allowed"
+			return model, apiErr
+		}
+	}
+	model, err := options.Apply(model)
+	if err != nil {
+		return model, newAPIError(err.Error(), http.StatusBadRequest)
+	}
+	if key.Template != "" {
+		model.Template = key.Template
+	}
+	return model, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"log"
+	"net/http"
+	"slices"
+)
+
+var jsonAttempts = 3
+
+// ConfigureJSONAttempts sets how many times Grok is asked for a valid JSON
+// answer before the request fails.
+func ConfigureJSONAttempts(n int) {
+	if n < 1 {
+		n = 1
+	}
+	jsonAttempts = n
+}
+
+// serveJSONMode asks Grok for an answer in the requested JSON format. Each
+// answer is validated as a whole, and on failure Grok is asked again with the
+// error, in a new chat on whichever session is free. Since nothing can be sent
+// before validation, a streamed response carries the answer in one chunk.
+func serveJSONMode(ctx context.Context, w http.ResponseWriter, stream bool, opts chatOptions, prompt grokPrompt, images []string, format *utils.ResponseFormat) {
+	// reasoning inline would break the JSON, so it is kept apart and only
+	// returned in separate mode
+	collectMode := ReasoningSeparate
+	if opts.mode == ReasoningNone {
+		collectMode = ReasoningNone
+	}
+	attemptPrompt := prompt
+	var lastErr *apiError
+	for attempt := 1; attempt <= jsonAttempts; attempt++ {
+		responseChan, cancelFunc, err := askGrok(ctx, opts.grokModel, nil, attemptPrompt, images)
+		if err != nil {
+			writeAPIError(w, toAPIError(err))
+			log.Println(err)
+			return
+		}
+		result := collect(responseChan, collectMode, opts.toolCallParser(), opts.outputLimits(cancelFunc))
+		cancelFunc()
+		if ctx.Err() != nil {
+			log.Println("Client went away, not asking Grok again")
+			return
+		}
+		if opts.mode != ReasoningSeparate {
+			result.reasoning = ""
+		}
+		if len(result.toolCalls) > 0 || result.finishReason == "length" {
+			// calling a tool is an acceptable answer, the JSON comes later,
+			// and a cut answer is returned as it is, like OpenAI does
+			writeChatResult(w, stream, result, opts)
+			return
+		}
+		if result.content == "" {
+			lastErr = grokFailed(result.err)
+			log.Printf("JSON attempt %d of %d: %v", attempt, jsonAttempts, lastErr)
+			continue
+		}
+		text, err := utils.ValidateJSONAnswer(result.content, format)
+		if err == nil {
+			result.content = text
+			writeChatResult(w, stream, result, opts)
+			return
+		}
+		lastErr = newAPIError(fmt.Sprintf("invalid answer: %v", err), http.StatusBadGateway)
+		lastErr.code = "invalid_json"
+		log.Printf("JSON attempt %d of %d: %v", attempt, jsonAttempts, lastErr)
+		attemptPrompt = messagePrompt(opts.grokModel, slices.Concat(prompt.msgs, utils.FormatJSONRetry(result.content, err)))
+		opts.promptTokens = utils.EstimateTokens(attemptPrompt.text)
+	}
+	apiErr := *lastErr
+	apiErr.message = fmt.Sprintf("Grok did not return valid JSON after %d attempts: %s", jsonAttempts, lastErr.message)
+	writeAPIError(w, &apiErr)
+	log.Println(apiErr.message)
+}
+
+// writeChatResult sends a complete result either as a chat completion or as a
+// short stream of chunks.
+func writeChatResult(w http.ResponseWriter, stream bool, result result, opts chatOptions) {
+	if !stream {
+		writeJSON(w, buildChatResponse(result, opts))
+		return
+	}
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+	chunks := []*utils.OpenAIStreamingResponseChunk{
+		utils.BuildChunkStart(result.content, result.reasoning, opts.requestID, opts.model),
+	}
+	if len(result.toolCalls) > 0 {
+		chunks = append(chunks, utils.BuildChunkToolCalls(result.toolCalls, opts.requestID, opts.model))
+	}
+	chunks = append(chunks, utils.BuildChunkFinish(opts.requestID, opts.model, result.finishReason))
+	if opts.includeUsage {
+		usage := chatUsage(opts.promptTokens, result.mode, result.content, result.toolCalls, result.reasoningTokens)
+		chunks = append(chunks, utils.BuildChunkUsage(opts.requestID, opts.model, usage))
+	}
+	for _, chunk := range chunks {
+		if err := sendChunk(w, flusher, chunk); err != nil {
+			log.Printf("Failed to send chunk: %v", err)
+			return
+		}
+	}
+	if err := endStream(w, flusher); err != nil {
+		log.Printf("Failed to send chunk: %v", err)
+		return
+	}
+	log.Println("Finished sending response")
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"grok-chat-proxy2/utils"
+)
+
+// tokenLimiter cuts the answer once its estimated tokens reach max. The
+// estimate is taken over the whole answer so far, as estimating each delta on
+// its own overcounts words split over several deltas.
+type tokenLimiter struct {
+	max int
+	// counted are the tokens of the answer up to its last token break, which
+	// later text cannot change, and tail is the text since
+	counted int
+	tail    string
+}
+
+// take returns the part of delta that still fits, and whether any of it had
+// to be cut.
+func (l *tokenLimiter) take(delta string) (string, bool) {
+	if l.max <= 0 || delta == "" {
+		return delta, false
+	}
+	if l.estimate(delta) <= l.max {
+		l.add(delta)
+		return delta, false
+	}
+	// find the longest prefix that still fits
+	runes := []rune(delta)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if l.estimate(string(runes[:mid])) <= l.max {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	l.add(string(runes[:lo]))
+	return string(runes[:lo]), true
+}
+
+func (l *tokenLimiter) estimate(delta string) int {
+	return l.counted + utils.EstimateTokens(l.tail+delta)
+}
+
+func (l *tokenLimiter) add(delta string) {
+	from := len(l.tail)
+	l.tail += delta
+	if i := utils.LastTokenBreak(l.tail, from); i > 0 {
+		l.counted += utils.EstimateTokens(l.tail[:i])
+		l.tail = l.tail[i:]
+	}
+}
+
+// outputLimits ends an answer at a stop sequence or once it reaches its token
+// limit. Either way the Grok generation is cancelled right away, so it does
+// not keep using up the account. It also drops a repeat of the prefill the
+// answer continues. A nil *outputLimits lets everything through.
+type outputLimits struct {
+	prefill *prefillScanner
+	stop    *stopScanner
+	tokens  tokenLimiter
+	cancel  context.CancelFunc
+	// reason is the finish reason once the answer was cut: "stop" or "length"
+	reason string
+}
+
+func newOutputLimits(stops []string, maxTokens int, prefill string, cancel context.CancelFunc) *outputLimits {
+	return &outputLimits{
+		prefill: newPrefillScanner(prefill),
+		stop:    newStopScanner(stops),
+		tokens:  tokenLimiter{max: maxTokens},
+		cancel:  cancel,
+	}
+}
+
+// done reports whether the answer has been cut. Events after that, including
+// the error caused by the cancellation, should be ignored.
+func (l *outputLimits) done() bool {
+	return l != nil && l.reason != ""
+}
+
+// truncated reports whether the answer was cut at the token limit, in which
+// case anything held back is dropped as well.
+func (l *outputLimits) truncated() bool {
+	return l != nil && l.reason == "length"
+}
+
+// text scans answer text for stop sequences and returns the part to keep.
+func (l *outputLimits) text(delta string) string {
+	if l == nil || l.done() {
+		return delta
+	}
+	delta, stopped := l.stop.push(l.prefill.push(delta))
+	if stopped {
+		l.end("stop")
+	}
+	return delta
+}
+
+// take cuts the text of an answer or reasoning event to the token limit,
+// before it is rendered, so that the tags around reasoning are neither counted
+// nor cut. reasoning tells whether reasoning is returned to the client at all;
+// when it is not, it does not count.
+func (l *outputLimits) take(event utils.Event, reasoning bool) utils.Event {
+	if l == nil {
+		return event
+	}
+	if l.truncated() {
+		event.Text = ""
+		return event
+	}
+	switch event.Type {
+	case utils.EventText:
+	case utils.EventReasoning, utils.EventResearch:
+		if !reasoning {
+			return event
+		}
+	default:
+		return event
+	}
+	text, cut := l.tokens.take(event.Text)
+	event.Text = text
+	if cut {
+		l.end("length")
+	}
+	return event
+}
+
+// flush returns the text held back at the end of the answer.
+func (l *outputLimits) flush() string {
+	if l == nil || l.done() {
+		return ""
+	}
+	text := l.text(l.prefill.flush())
+	if l.done() {
+		return text
+	}
+	return text + l.stop.flush()
+}
+
+// stopSequence returns the stop sequence the answer was cut at, if any.
+func (l *outputLimits) stopSequence() string {
+	if l == nil || l.reason != "stop" {
+		return ""
+	}
+	return l.stop.matched
+}
+
+// finishReason overrides the reason Grok gave when the answer was cut.
+func (l *outputLimits) finishReason(reason string) string {
+	if l.done() {
+		return l.reason
+	}
+	return reason
+}
+
+func (l *outputLimits) end(reason string) {
+	if l.reason != "" {
+		return
+	}
+	l.reason = reason
+	if l.cancel != nil {
+		l.cancel()
+	}
+}
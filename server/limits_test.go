@@ -0,0 +1,148 @@
+package server
+
+import (
+	"grok-chat-proxy2/utils"
+	"strings"
+	"testing"
+)
+
+func TestTokenLimiter(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		deltas []string
+		want   string
+		cut    bool
+	}{
+		{"no limit", 0, []string{"Hello", " world"}, "Hello world", false},
+		{"under the limit", 10, []string{"Hello", " world"}, "Hello world", false},
+		{"exactly at the limit", 2, []string{"Hello", " world"}, "Hello world", false},
+		{"cut inside a delta", 2, []string{"Hello wo", "rld! And", " more"}, "Hello world", true},
+		{"word split over deltas counts once", 3, []string{"Hel", "lo", " wor", "ld", "!"}, "Hello world!", false},
+		{"nothing after the cut", 1, []string{"Hello", " world", " again"}, "Hello", true},
+		{"long line without spaces", 5, []string{`{"a":`, `1,"b":`, `2,"c":3}`}, `{"a":`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tokenLimiter{max: tt.max}
+			got, cut := "", false
+			for _, delta := range tt.deltas {
+				if cut {
+					break
+				}
+				var text string
+				text, cut = l.take(delta)
+				got += text
+			}
+			if got != tt.want || cut != tt.cut {
+				t.Errorf("got %q, cut %v; want %q, cut %v", got, cut, tt.want, tt.cut)
+			}
+			if tt.max > 0 && utils.EstimateTokens(got) > tt.max {
+				t.Errorf("%q is %d tokens, more than %d", got, utils.EstimateTokens(got), tt.max)
+			}
+		})
+	}
+}
+
+func TestTokenLimiterCountsLikeTheWholeText(t *testing.T) {
+	text := strings.Repeat("Some words, 12345 digits\tand {\"json\":[1,2]} 漢字 here.\n", 50)
+	l := tokenLimiter{max: 1 << 30}
+	for i := 0; i < len(text); i += 7 {
+		l.take(text[i:min(i+7, len(text))])
+	}
+	if got, want := l.counted+utils.EstimateTokens(l.tail), utils.EstimateTokens(text); got != want {
+		t.Errorf("counted %d tokens, want %d", got, want)
+	}
+	if len(l.tail) > 16 {
+		t.Errorf("tail %q was not folded into the count", l.tail)
+	}
+}
+
+func TestOutputLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		stops     []string
+		maxTokens int
+		prefill   string
+		reasoning bool
+		events    []utils.Event
+		want      string
+		reason    string
+		stop      string
+	}{
+		{
+			name:   "nothing to cut",
+			events: []utils.Event{utils.TextEvent("Hello"), utils.TextEvent(" world")},
+			want:   "Hello world", reason: "stop",
+		},
+		{
+			name:   "stop sequence",
+			stops:  []string{"wor"},
+			events: []utils.Event{utils.TextEvent("Hello"), utils.TextEvent(" world")},
+			want:   "Hello ", reason: "stop", stop: "wor",
+		},
+		{
+			name:      "token limit",
+			maxTokens: 1,
+			events:    []utils.Event{utils.TextEvent("Hello"), utils.TextEvent(" world")},
+			want:      "Hello", reason: "length",
+		},
+		{
+			name:      "hidden reasoning does not count",
+			maxTokens: 1,
+			events:    []utils.Event{utils.ReasoningEvent("Let me think"), utils.TextEvent("Hello")},
+			want:      "Hello", reason: "stop",
+		},
+		{
+			name:      "shown reasoning counts",
+			maxTokens: 2,
+			reasoning: true,
+			events:    []utils.Event{utils.ReasoningEvent("Let me think"), utils.TextEvent("Hello")},
+			want:      "", reason: "length",
+		},
+		{
+			name:    "repeated prefill is dropped",
+			prefill: "The answer is twenty",
+			events:  []utils.Event{utils.TextEvent("The answer is "), utils.TextEvent("twenty"), utils.TextEvent("-two.")},
+			want:    "-two.", reason: "stop",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancelled := false
+			l := newOutputLimits(tt.stops, tt.maxTokens, tt.prefill, func() { cancelled = true })
+			var got strings.Builder
+			for _, event := range tt.events {
+				if l.done() {
+					continue
+				}
+				if event.Type == utils.EventText {
+					event.Text = l.text(event.Text)
+				}
+				if event = l.take(event, tt.reasoning); event.Type == utils.EventText {
+					got.WriteString(event.Text)
+				}
+			}
+			got.WriteString(l.flush())
+			if got.String() != tt.want {
+				t.Errorf("got %q, want %q", got.String(), tt.want)
+			}
+			if reason := l.finishReason("stop"); reason != tt.reason {
+				t.Errorf("finish reason %q, want %q", reason, tt.reason)
+			}
+			if stop := l.stopSequence(); stop != tt.stop {
+				t.Errorf("stop sequence %q, want %q", stop, tt.stop)
+			}
+			if cancelled != l.done() {
+				t.Errorf("cancelled %v, done %v", cancelled, l.done())
+			}
+		})
+	}
+}
+
+func TestNilOutputLimits(t *testing.T) {
+	var l *outputLimits
+	if l.done() || l.text("a") != "a" || l.take(utils.TextEvent("b"), true).Text != "b" || l.flush() != "" || l.finishReason("x") != "x" {
+		t.Error("a nil *outputLimits should let everything through")
+	}
+}
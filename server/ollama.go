@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OllamaChatHandler serves Ollama's /api/chat on top of the same sessions as
+// ChatCompletionHandler.
+func OllamaChatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOllamaError(w, newAPIError("Only POST method is allowed", http.StatusMethodNotAllowed))
+		return
+	}
+	var request utils.OllamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errMsg := fmt.Sprintf("Failed to parse request body: %v", err)
+		writeOllamaError(w, newAPIError(errMsg, http.StatusBadRequest))
+		log.Println(errMsg)
+		return
+	}
+	defer r.Body.Close()
+	grokModel, apiErr := resolveModel(r, ollamaModelName(request.Model), request.Grok)
+	if apiErr != nil {
+		writeOllamaError(w, apiErr)
+		log.Println(apiErr)
+		return
+	}
+	msgs := request.ToMessages()
+	prompt := messagePrompt(grokModel, msgs)
+	serveOllama(r.Context(), w, grokModel, prompt, utils.MessageImages(msgs), request.ReasoningMode, request.Think, request.Options, utils.OllamaStreaming(request.Stream), func(content string, thinking string) *utils.OllamaResponse {
+		return utils.BuildOllamaChatRecord(content, thinking, request.Model)
+	})
+}
+
+// OllamaGenerateHandler serves Ollama's /api/generate. With raw set the prompt
+// is sent to Grok as it is.
+func OllamaGenerateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOllamaError(w, newAPIError("Only POST method is allowed", http.StatusMethodNotAllowed))
+		return
+	}
+	var request utils.OllamaGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errMsg := fmt.Sprintf("Failed to parse request body: %v", err)
+		writeOllamaError(w, newAPIError(errMsg, http.StatusBadRequest))
+		log.Println(errMsg)
+		return
+	}
+	defer r.Body.Close()
+	grokModel, apiErr := resolveModel(r, ollamaModelName(request.Model), request.Grok)
+	if apiErr != nil {
+		writeOllamaError(w, apiErr)
+		log.Println(apiErr)
+		return
+	}
+	msgs := request.ToMessages()
+	prompt := rawPrompt(request.Prompt)
+	if !request.Raw {
+		prompt = messagePrompt(grokModel, msgs)
+	}
+	serveOllama(r.Context(), w, grokModel, prompt, utils.MessageImages(msgs), request.ReasoningMode, request.Think, request.Options, utils.OllamaStreaming(request.Stream), func(content string, thinking string) *utils.OllamaResponse {
+		return utils.BuildOllamaGenerateRecord(content, thinking, request.Model)
+	})
+}
+
+func OllamaTagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOllamaError(w, newAPIError("Only GET method is allowed", http.StatusMethodNotAllowed))
+		return
+	}
+	writeJSON(w, utils.OllamaTags(models.Listed()))
+}
+
+// ollamaModelName drops the default tag Ollama clients add to model names.
+func ollamaModelName(model string) string {
+	return strings.TrimSuffix(model, ":latest")
+}
+
+// ollamaReasoningMode maps Ollama's think flag to a reasoning mode: thinking
+// goes to its own field when asked for and is dropped when turned off.
+func ollamaReasoningMode(requested string, think *bool) (string, error) {
+	mode, err := resolveReasoningMode(requested)
+	if err != nil || think == nil {
+		return mode, err
+	}
+	if *think {
+		return ReasoningSeparate, nil
+	}
+	return ReasoningNone, nil
+}
+
+func serveOllama(ctx context.Context, w http.ResponseWriter, grokModel utils.Model, prompt grokPrompt, images []string, requestedMode string, think *bool, options *utils.OllamaOptions, stream bool, build func(content string, thinking string) *utils.OllamaResponse) {
+	mode, err := ollamaReasoningMode(requestedMode, think)
+	if err != nil {
+		writeOllamaError(w, newAPIError(err.Error(), http.StatusBadRequest))
+		log.Println(err)
+		return
+	}
+	start := time.Now()
+	promptTokens := utils.EstimateTokens(prompt.text)
+	responseChan, cancelFunc, err := askGrok(ctx, grokModel, nil, prompt, images)
+	if err != nil {
+		writeOllamaError(w, toAPIError(err))
+		log.Println(err)
+		return
+	}
+	defer cancelFunc()
+	var limits *outputLimits
+	if options != nil {
+		limits = newOutputLimits(options.Stop, options.NumPredict, "", cancelFunc)
+	}
+
+	if !stream {
+		result := collect(responseChan, mode, nil, limits)
+		if result.content == "" && result.reasoning == "" && !result.cut {
+			apiErr := grokFailed(result.err)
+			writeOllamaError(w, apiErr)
+			log.Println(apiErr)
+			return
+		}
+		completionTokens := utils.EstimateTokens(result.content) + utils.EstimateTokens(result.reasoning)
+		writeJSON(w, build(result.content, result.reasoning).Finish(result.finishReason, time.Since(start), promptTokens, completionTokens))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errMsg := "Streaming unsupported!"
+		writeOllamaError(w, newAPIError(errMsg, http.StatusInternalServerError))
+		log.Println(errMsg)
+		return
+	}
+	processOllamaStream(responseChan, mode, start, promptTokens, limits, build, w, flusher)
+}
+
+// processOllamaStream writes one NDJSON record per delta, then a final record
+// with done set.
+func processOllamaStream(responseChan chan utils.Event, mode string, start time.Time, promptTokens int, limits *outputLimits, build func(content string, thinking string) *utils.OllamaResponse, w http.ResponseWriter, flusher http.Flusher) {
+	defer func() {
+		for range responseChan {
+		}
+	}()
+	renderer := newRenderer(mode)
+	// the output is kept to estimate its tokens once, as the non-stream path does
+	var text, thought strings.Builder
+	finishReason := "stop"
+	var grokErr error
+	send := func(content string, thinking string) error {
+		if content == "" && thinking == "" {
+			return nil
+		}
+		text.WriteString(content)
+		thought.WriteString(thinking)
+		return sendOllamaRecord(w, flusher, build(content, thinking))
+	}
+	for event := range responseChan {
+		if limits.done() {
+			continue
+		}
+		switch event.Type {
+		case utils.EventError:
+			grokErr = event.Err
+			continue
+		case utils.EventFinish:
+			finishReason = event.FinishReason
+			continue
+		case utils.EventMetadata:
+			continue
+		case utils.EventText:
+			event.Text = limits.text(event.Text)
+		}
+		content, thinking := renderer.render(limits.take(event, mode != ReasoningNone))
+		if err := send(content, thinking); err != nil {
+			log.Printf("Failed to send record: %v", err)
+			return
+		}
+	}
+	if text := limits.flush(); text != "" {
+		content, _ := renderer.render(limits.take(utils.TextEvent(text), false))
+		if err := send(content, ""); err != nil {
+			log.Printf("Failed to send record: %v", err)
+			return
+		}
+	}
+	if err := send(renderer.flush(), ""); err != nil {
+		log.Printf("Failed to send record: %v", err)
+		return
+	}
+	if grokErr != nil {
+		log.Printf("Grok response ended with error: %v", grokErr)
+		if err := sendOllamaRecord(w, flusher, utils.OllamaError{Error: toAPIError(grokErr).message}); err != nil {
+			log.Printf("Failed to send record: %v", err)
+		}
+		return
+	}
+	completionTokens := utils.EstimateTokens(text.String()) + utils.EstimateTokens(thought.String())
+	final := build("", "").Finish(limits.finishReason(finishReason), time.Since(start), promptTokens, completionTokens)
+	if err := sendOllamaRecord(w, flusher, final); err != nil {
+		log.Printf("Failed to send record: %v", err)
+		return
+	}
+	log.Println("Finished sending response")
+}
+
+func sendOllamaRecord(w http.ResponseWriter, flusher http.Flusher, record any) error {
+	recordData, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", recordData); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
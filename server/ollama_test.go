@@ -0,0 +1,158 @@
+package server
+
+import (
+	"grok-chat-proxy2/client"
+	"grok-chat-proxy2/utils"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOllamaChatHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []utils.Event
+		body   string
+		status int
+		want   []string
+	}{
+		{
+			name:   "answer",
+			events: answer,
+			body:   `{"model":"grok-3:latest","stream":false,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"model":"grok-3:latest"`, `"content":"\n\u003cthink\u003e\nThinking it over.\n\u003c/think\u003e\nHello there!"`, `"done":true`, `"done_reason":"stop"`},
+		},
+		{
+			name:   "think",
+			events: answer,
+			body:   `{"model":"grok-3","stream":false,"think":true,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"content":"Hello there!"`, `"thinking":"Thinking it over."`},
+		},
+		{
+			name:   "stream",
+			events: answer,
+			body:   `{"model":"grok-3","think":false,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"content":"Hello"},"done":false`, `"content":" there!"},"done":false`, `"done":true,"done_reason":"stop"`},
+		},
+		{
+			name:   "num_predict",
+			events: answer,
+			body:   `{"model":"grok-3","stream":false,"think":false,"options":{"num_predict":1},"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"content":"Hello"`, `"done_reason":"length"`},
+		},
+		{
+			name:   "stop",
+			events: answer,
+			body:   `{"model":"grok-3","stream":false,"think":false,"options":{"stop":["!"]},"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"content":"Hello there"`, `"done_reason":"stop"`},
+		},
+		{
+			name:   "empty answer",
+			events: []utils.Event{utils.FinishEvent("stop")},
+			body:   `{"model":"grok-3","stream":false,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusBadGateway,
+			want:   []string{`"error":`},
+		},
+		{
+			name:   "rate limited",
+			events: []utils.Event{utils.ErrorEvent(client.ErrRateLimited)},
+			body:   `{"model":"grok-3","stream":false,"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusTooManyRequests,
+			want:   []string{`"error":`},
+		},
+		{
+			name:   "unknown model",
+			body:   `{"model":"llama3","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusBadRequest,
+			want:   []string{`"error":"Unsupported model: llama3"`},
+		},
+		{
+			name:   "invalid body",
+			body:   `{"model":`,
+			status: http.StatusBadRequest,
+			want:   []string{`"error":"Failed to parse request body`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestGrok(t, tt.events...)
+			rec := serve(OllamaChatHandler, http.MethodPost, "/api/chat", tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("missing %s in:\n%s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestOllamaGenerateHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		prompt string
+		// raw prompts are sent as they are, without role labels
+		raw  bool
+		want []string
+	}{
+		{
+			name:   "answer",
+			body:   `{"model":"grok-3","stream":false,"think":false,"prompt":"Hi"}`,
+			prompt: "human: Hi",
+			want:   []string{`"response":"Hello there!"`, `"done":true`},
+		},
+		{
+			name:   "raw",
+			body:   `{"model":"grok-3","stream":false,"think":false,"raw":true,"prompt":"Hi"}`,
+			prompt: "Hi",
+			raw:    true,
+			want:   []string{`"response":"Hello there!"`},
+		},
+		{
+			name:   "stream",
+			body:   `{"model":"grok-3","think":true,"prompt":"Hi"}`,
+			prompt: "human: Hi",
+			want:   []string{`"thinking":"Thinking it over."`, `"response":"Hello"`, `"done":true`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grok := useTestGrok(t, answer...)
+			rec := serve(OllamaGenerateHandler, http.MethodPost, "/api/generate", tt.body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("missing %s in:\n%s", want, rec.Body.String())
+				}
+			}
+			prompt := grok.lastPrompt()
+			if tt.raw && prompt != tt.prompt || !strings.Contains(prompt, tt.prompt) {
+				t.Errorf("unexpected prompt %q, want %q", prompt, tt.prompt)
+			}
+		})
+	}
+}
+
+func TestOllamaTagsHandler(t *testing.T) {
+	rec := serve(OllamaTagsHandler, http.MethodGet, "/api/tags", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"name":"grok-3"`) {
+		t.Errorf("grok-3 not listed: %s", rec.Body.String())
+	}
+	rec = serve(OllamaTagsHandler, http.MethodPost, "/api/tags", "")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+)
+
+// minPrefillRepeat is how long a repeated tail of the prefill must be to be
+// dropped. Shorter matches are too likely to be the real continuation.
+const minPrefillRepeat = 16
+
+// prefillScanner drops the start of an answer that repeats the assistant
+// prefill it is meant to continue. Grok tends to write the whole prefill, or
+// its last sentence, again before going on. The start of the answer is held
+// back until it is clear whether it is a repeat.
+type prefillScanner struct {
+	// candidates are the prefill and its tails starting at a word, longest first
+	candidates []string
+	pending    string
+	done       bool
+}
+
+func newPrefillScanner(prefill string) *prefillScanner {
+	prefill = strings.TrimSpace(prefill)
+	if prefill == "" {
+		return nil
+	}
+	candidates := []string{prefill}
+	for i, r := range prefill {
+		if i == 0 || !unicode.IsSpace(r) {
+			continue
+		}
+		tail := strings.TrimLeftFunc(prefill[i:], unicode.IsSpace)
+		if len(tail) < minPrefillRepeat {
+			break
+		}
+		if tail != candidates[len(candidates)-1] {
+			candidates = append(candidates, tail)
+		}
+	}
+	return &prefillScanner{candidates: candidates}
+}
+
+// push returns the part of delta that can be sent.
+func (s *prefillScanner) push(delta string) string {
+	if s == nil || s.done {
+		return delta
+	}
+	s.pending += delta
+	text := strings.TrimLeftFunc(s.pending, unicode.IsSpace)
+	if text == "" {
+		return ""
+	}
+	for _, candidate := range s.candidates {
+		if len(text) < len(candidate) && strings.HasPrefix(candidate, text) {
+			// could still become a repeat
+			return ""
+		}
+	}
+	return s.release()
+}
+
+// flush returns the text held back when the answer ends.
+func (s *prefillScanner) flush() string {
+	if s == nil || s.done {
+		return ""
+	}
+	return s.release()
+}
+
+// release drops the longest repeat the held back text starts with and
+// returns the rest.
+func (s *prefillScanner) release() string {
+	s.done = true
+	pending := s.pending
+	s.pending = ""
+	text := strings.TrimLeftFunc(pending, unicode.IsSpace)
+	for _, candidate := range s.candidates {
+		if strings.HasPrefix(text, candidate) {
+			return text[len(candidate):]
+		}
+	}
+	return pending
+}
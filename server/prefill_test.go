@@ -0,0 +1,34 @@
+package server
+
+import "testing"
+
+func TestPrefillScanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefill string
+		deltas  []string
+		want    string
+	}{
+		{"no prefill", "", []string{"Hello"}, "Hello"},
+		{"real continuation", "The answer is", []string{" forty", "-two."}, " forty-two."},
+		{"whole prefill repeated", "The answer is", []string{"The ans", "wer is forty-two."}, " forty-two."},
+		{"repeat after whitespace", "The answer is", []string{"\n", "The answer is", " 42"}, " 42"},
+		{"last sentence repeated", "First we count. Then the answer is", []string{"Then the answer is", " 42"}, " 42"},
+		{"short tail is kept", "First we count. It is", []string{"It is 42"}, "It is 42"},
+		{"answer ends while held back", "The answer is", []string{"The ans"}, "The ans"},
+		{"repeat only at the start", "The answer is", []string{"42. ", "The answer is"}, "42. The answer is"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPrefillScanner(tt.prefill)
+			got := ""
+			for _, delta := range tt.deltas {
+				got += s.push(delta)
+			}
+			got += s.flush()
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"slices"
+	"strings"
+)
+
+var attachmentSize = 100000
+
+// ConfigurePromptLength sets how long a prompt may be before it is uploaded
+// instead of typed in.
+func ConfigurePromptLength(n int) {
+	if n < 1000 {
+		n = 1000
+	}
+	MAX_PROMPT_LENGTH = n
+}
+
+// ConfigureAttachmentSize sets how long each file a prompt is uploaded in may
+// be. Longer prompts are split over several files.
+func ConfigureAttachmentSize(n int) {
+	if n < 1000 {
+		n = 1000
+	}
+	attachmentSize = n
+}
+
+// grokPrompt is a prompt for askGrok. A prompt written from messages keeps
+// them, so that when it is too long to type in, only the older history has to
+// be uploaded.
+type grokPrompt struct {
+	text string
+	// msgs are the messages the text was written from, nil for a raw prompt
+	msgs []utils.Message
+}
+
+func messagePrompt(model utils.Model, msgs []utils.Message) grokPrompt {
+	return grokPrompt{text: model.FormatPrompt(msgs), msgs: msgs}
+}
+
+func rawPrompt(text string) grokPrompt {
+	return grokPrompt{text: text}
+}
+
+// promptFile is a piece of a prompt to upload.
+type promptFile struct {
+	name string
+	text string
+}
+
+// attach splits the prompt into what is typed in and the files to upload. The
+// system messages and the latest turn stay in the message box, with a note
+// pointing at the files holding the history before it. When there is no
+// history, or the rest is still too long, the whole prompt is uploaded.
+// batch makes the file names unique.
+func (p grokPrompt) attach(model utils.Model, batch int64) (string, []promptFile) {
+	if p.msgs != nil {
+		system, history, latest := utils.SplitHistory(utils.NumberImages(p.msgs))
+		if len(history) > 0 {
+			files := promptFiles(model.FormatPrompt(history), "history", batch)
+			note := fmt.Sprintf("The earlier part of this conversation is attached as %s. Read the history first, the conversation continues below.", fileList(files))
+			inline := model.FormatPrompt(slices.Concat(system, utils.SystemMessages(note), latest))
+			if len(inline) <= MAX_PROMPT_LENGTH {
+				return inline, files
+			}
+		}
+	}
+	files := promptFiles(p.text, "prompt", batch)
+	note := fmt.Sprintf("The prompt is attached as %s. Reply to it as if it had been written here.", fileList(files))
+	return model.FormatPrompt(utils.SystemMessages(note)), files
+}
+
+func promptFiles(text string, prefix string, batch int64) []promptFile {
+	pieces := utils.SplitText(text, attachmentSize)
+	files := make([]promptFile, len(pieces))
+	for i, piece := range pieces {
+		files[i] = promptFile{name: fmt.Sprintf("%s-%d-%d.txt", prefix, batch, i+1), text: piece}
+	}
+	return files
+}
+
+// fileList names the files for Grok, in the order they are to be read.
+func fileList(files []promptFile) string {
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.name
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return fmt.Sprintf("%d files, to be read in this order: %s", len(names), strings.Join(names, ", "))
+}
@@ -8,129 +8,482 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
-var callGrok func(model string, prompt *string, responseChan chan string) (context.CancelFunc, error)
-var callGrokUsingFile func(model string, prompt *string, filename string, responseChan chan string) (context.CancelFunc, error)
+var callGrok func(model utils.Model, conversation *utils.Conversation, prompt *string, capture string, responseChan chan utils.Event) (context.CancelFunc, error)
+var callGrokWithFiles func(model utils.Model, conversation *utils.Conversation, prompt *string, filenames []string, capture string, responseChan chan utils.Event) (context.CancelFunc, error)
 var expectedAPIKey string
+var localImageDir string
 var MAX_PROMPT_LENGTH = 40000
 
 func ChatCompletionHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	var request utils.OpenAIRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		errMsg := fmt.Sprintf("Failed to parse request body: %v", err)
-		http.Error(w, errMsg, http.StatusBadRequest)
+		writeError(w, errMsg, http.StatusBadRequest)
 		log.Println(errMsg)
 		return
 	}
 	defer r.Body.Close()
-	if !request.Stream {
-		errMsg := "Only support stream mode"
-		http.Error(w, errMsg, http.StatusBadRequest)
+	requestID := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	modelName := request.Model
+	grokModel, apiErr := resolveModel(r, modelName, request.Grok)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		log.Println(apiErr)
 		return
 	}
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		errMsg := "Streaming unsupported!"
-		http.Error(w, errMsg, http.StatusInternalServerError)
-		log.Println(errMsg)
+	mode, err := resolveReasoningMode(request.ReasoningMode)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
 		return
 	}
-	requestID := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
-	modelName := request.Model
-	if modelName != "grok-3" && modelName != "grok-3-think" && modelName != "grok-3-deepsearch" && modelName != "grok-3-deepersearch" {
-		errMsg := fmt.Sprintf("Unsupported model: %s", modelName)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		log.Println(errMsg)
+
+	if err := utils.ValidateMessages(request.Messages); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
 		return
 	}
 
-	prompt := utils.PromptHandler(request.Messages)
-	cwd, err := os.Getwd()
+	if err := utils.ValidateTools(request.Tools, request.ToolChoice); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	if err := request.ResponseFormat.Validate(); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+
+	prefill := utils.Prefill(request.Messages)
+	prompt := messagePrompt(grokModel, slices.Concat(utils.FormatTools(request.Tools, request.ToolChoice), request.Messages, utils.FormatPrefill(prefill), utils.FormatResponseFormat(request.ResponseFormat)))
+	opts := chatOptions{
+		requestID:    requestID,
+		model:        modelName,
+		grokModel:    grokModel,
+		mode:         mode,
+		promptTokens: utils.EstimateTokens(prompt.text),
+		tools:        utils.ToolsEnabled(request.Tools, request.ToolChoice),
+		stop:         request.Stop,
+		maxTokens:    request.TokenLimit(),
+		prefill:      prefill,
+		includeUsage: request.StreamOptions.Usage(),
+	}
+	if request.ResponseFormat.IsJSON() {
+		if request.N > 1 {
+			errMsg := "n > 1 is not supported with response_format"
+			writeError(w, errMsg, http.StatusBadRequest)
+			log.Println(errMsg)
+			return
+		}
+		serveJSONMode(r.Context(), w, request.Stream, opts, prompt, utils.MessageImages(request.Messages), request.ResponseFormat)
+		return
+	}
+	var choices []grokChoice
+	var cancelFunc context.CancelFunc
+	if canContinue(grokModel, request) {
+		// only a plain chat can go on in the same Grok conversation, since
+		// the instructions for tools and formats are part of each prompt
+		var responseChan chan utils.Event
+		opts.apiKey = requestAPIKey(r).Key
+		responseChan, cancelFunc, opts.continued, err = askGrokContinuing(r.Context(), grokModel, opts.apiKey, request.Messages, prompt, utils.MessageImages(request.Messages))
+		choices = []grokChoice{{responseChan: responseChan, cancel: cancelFunc}}
+		opts.history = request.Messages
+		// when no answer replaced the continued conversation, it can be
+		// continued again
+		defer conversations.release(opts.continued)
+	} else {
+		choices, cancelFunc, err = askGrokChoices(r.Context(), grokModel, prompt, utils.MessageImages(request.Messages), request.N)
+	}
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to get current working directory: %v", err)
-		http.Error(w, errMsg, http.StatusInternalServerError)
-		log.Println(errMsg)
+		writeAPIError(w, toAPIError(err))
+		log.Println(err)
+		return
+	}
+	defer cancelFunc()
+
+	if !request.Stream {
+		processResponse(choices, opts, w)
+		return
+	}
+
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+	done := make(chan bool)
+	go processStreamChunk(choices, opts, w, flusher, done)
+	<-done
+}
+
+// chatOptions is what the response writers need to know about a chat
+// completion request.
+type chatOptions struct {
+	requestID string
+	// model is the name the client asked for, grokModel what it resolved to
+	model        string
+	grokModel    utils.Model
+	mode         string
+	promptTokens int
+	// tools is set when Grok was told about tools, so its answer may hold calls
+	tools bool
+	// stop and maxTokens end the answer early, maxTokens is 0 for no limit
+	stop      []string
+	maxTokens int
+	// prefill is the unfinished assistant message the answer continues
+	prefill string
+	// includeUsage ends a stream with a usage chunk
+	includeUsage bool
+	// history is set when the answer is to be remembered so that the next
+	// request can continue the conversation, continued when it continues one.
+	// Conversations are only continued with the API key they were started with.
+	history   []utils.Message
+	continued *conversationEntry
+	apiKey    string
+}
+
+// canContinue reports whether the request is a plain chat that can continue a
+// Grok conversation. Private chats are not kept by Grok, and an answer
+// continuing a prefill is not the whole assistant turn.
+func canContinue(model utils.Model, request utils.OpenAIRequest) bool {
+	return !model.Private && len(request.Tools) == 0 && !request.ResponseFormat.IsJSON() && request.N <= 1 && utils.Prefill(request.Messages) == ""
+}
+
+// remember saves the conversation a complete answer is in.
+func (opts chatOptions) remember(answer string, conversation utils.Conversation) {
+	if opts.history == nil {
 		return
 	}
-	filepath := cwd + "/lastPrompt.txt"
-	file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	conversations.save(opts.history, answer, opts.grokModel.ID, opts.apiKey, conversation, opts.continued)
+}
+
+func (opts chatOptions) toolCallParser() *toolCallParser {
+	if !opts.tools {
+		return nil
+	}
+	return newToolCallParser()
+}
+
+// outputLimits returns the limits to apply to the answer, or nil when the
+// request set none. cancel abandons the Grok generation.
+func (opts chatOptions) outputLimits(cancel context.CancelFunc) *outputLimits {
+	if len(opts.stop) == 0 && opts.maxTokens <= 0 && opts.prefill == "" {
+		return nil
+	}
+	return newOutputLimits(opts.stop, opts.maxTokens, opts.prefill, cancel)
+}
+
+var models = defaultModels()
+
+func defaultModels() *utils.ModelRegistry {
+	registry, err := utils.NewModelRegistry(utils.DefaultModels())
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to open file: %v", err)
-		http.Error(w, errMsg, http.StatusInternalServerError)
-		log.Println(errMsg)
+		panic(err)
+	}
+	return registry
+}
+
+// ConfigureModels sets the models the server accepts and lists.
+func ConfigureModels(registry *utils.ModelRegistry) {
+	models = registry
+}
+
+// askGrok saves the prompt in the request's directory and sends it to the next
+// available session, which captures the raw answer stream next to it. A
+// prompt too long to type in is uploaded in files instead, or as the model's
+// attachment behavior says, see grokPrompt.attach. The model's custom
+// instructions go before the prompt, except when conversation is set: the
+// prompt is then posted into that chat, which has them already. Images are
+// uploaded along with the prompt and removed once the returned cancel
+// function is called. The generation is also cancelled when ctx is done, so a
+// client that goes away does not keep the session busy. Errors are either an
+// *apiError or an error from the client package, see toAPIError.
+func askGrok(ctx context.Context, model utils.Model, conversation *utils.Conversation, prompt grokPrompt, images []string) (chan utils.Event, context.CancelFunc, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if conversation == nil && model.CustomInstructions != "" {
+		if prompt.msgs != nil {
+			prompt = messagePrompt(model, slices.Concat(utils.SystemMessages(model.CustomInstructions), prompt.msgs))
+		} else {
+			prompt.text = model.FormatPrompt(utils.SystemMessages(model.CustomInstructions)) + prompt.text
+		}
+	}
+	upload := len(prompt.text) > MAX_PROMPT_LENGTH
+	switch model.Attachments {
+	case utils.AttachAlways:
+		upload = true
+	case utils.AttachNever:
+		upload = false
 	}
-	defer file.Close()
-	_, err = file.WriteString(prompt)
+	if model.ContextLimit > 0 {
+		if tokens := utils.EstimateTokens(prompt.text); tokens > model.ContextLimit {
+			apiErr := newAPIError(fmt.Sprintf("The prompt is %d tokens, more than the %d tokens %s accepts", tokens, model.ContextLimit, model.ID), http.StatusBadRequest)
+			apiErr.code = "context_length_exceeded"
+			return nil, nil, apiErr
+		}
+	}
+	call, err := requestDirOf(ctx).nextCall()
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to write to file: %v", err)
-		http.Error(w, errMsg, http.StatusInternalServerError)
-		log.Println(errMsg)
+		return nil, nil, newAPIError(fmt.Sprintf("Failed to create the request directory: %v", err), http.StatusInternalServerError)
 	}
-	done := make(chan bool)
-	responseChan := make(chan string, 20)
+	observed := false
+	defer func() {
+		// a call that never got to stream is over already
+		if !observed {
+			call.record.end()
+		}
+	}()
+	if err := os.WriteFile(call.prompt, []byte(prompt.text), 0644); err != nil {
+		log.Printf("Failed to write to file: %v", err)
+	}
+	var files, saved []string
+	uploadDir := call.uploads
+	removeSaved := func() {
+		for _, file := range saved {
+			os.Remove(file)
+		}
+		os.Remove(uploadDir)
+	}
+	batch := time.Now().UnixNano()
+	for i, image := range images {
+		file, err := utils.SaveImage(image, uploadDir, fmt.Sprintf("image-%d-%d", batch, i+1), localImageDir)
+		if err != nil {
+			removeSaved()
+			return nil, nil, newAPIError(fmt.Sprintf("Failed to load image %d: %v", i+1, err), http.StatusBadRequest)
+		}
+		if strings.HasPrefix(file, uploadDir) {
+			saved = append(saved, file)
+		}
+		files = append(files, file)
+	}
+	text := prompt.text
+	if upload {
+		var attached []promptFile
+		text, attached = prompt.attach(model, batch)
+		if err := utils.MakeDirIfNotExist(uploadDir); err != nil {
+			removeSaved()
+			return nil, nil, newAPIError(fmt.Sprintf("Failed to create %s: %v", uploadDir, err), http.StatusInternalServerError)
+		}
+		for _, file := range attached {
+			path := filepath.Join(uploadDir, file.name)
+			if err := os.WriteFile(path, []byte(file.text), 0644); err != nil {
+				removeSaved()
+				return nil, nil, newAPIError(fmt.Sprintf("Failed to write to file: %v", err), http.StatusInternalServerError)
+			}
+			saved = append(saved, path)
+			files = append(files, path)
+		}
+		log.Printf("Uploading the prompt in %d files", len(attached))
+	}
+	call.record.mu.Lock()
+	call.record.Model = model.ID
+	call.record.Prompt = text
+	for _, file := range files {
+		call.record.Attachments = append(call.record.Attachments, filepath.Base(file))
+	}
+	call.record.mu.Unlock()
+	responseChan := make(chan utils.Event, 20)
 	var allocErr error
 	var cancelFunc context.CancelFunc
-	if len(prompt) > MAX_PROMPT_LENGTH {
-		prompt = ""
-		cancelFunc, allocErr = callGrokUsingFile(modelName, &prompt, filepath, responseChan)
+	if len(files) > 0 {
+		cancelFunc, allocErr = callGrokWithFiles(model, conversation, &text, files, call.capture, responseChan)
 	} else {
-		cancelFunc, allocErr = callGrok(modelName, &prompt, responseChan)
+		cancelFunc, allocErr = callGrok(model, conversation, &text, call.capture, responseChan)
 	}
 	if allocErr != nil {
-		errMsg := fmt.Sprintf("Failed to allocate session: %v", allocErr)
-		http.Error(w, errMsg, http.StatusTooManyRequests)
+		removeSaved()
+		call.record.mu.Lock()
+		call.record.Error = allocErr.Error()
+		call.record.mu.Unlock()
+		return nil, nil, fmt.Errorf("Failed to allocate session: %w", allocErr)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		log.Println("Client went away, cancelling the generation")
+		cancelFunc()
+	})
+	observed = true
+	return call.record.observe(responseChan), func() {
+		stop()
+		cancelFunc()
+		removeSaved()
+	}, nil
+}
+
+// startEventStream sets the SSE headers. It reports an error to the client
+// when the writer cannot stream.
+func startEventStream(w http.ResponseWriter) (http.Flusher, bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errMsg := "Streaming unsupported!"
+		writeError(w, errMsg, http.StatusInternalServerError)
 		log.Println(errMsg)
+		return nil, false
+	}
+	return flusher, true
+}
+
+// processResponse collects every choice and sends them in one completion.
+// Choices Grok failed to answer are left out.
+func processResponse(choices []grokChoice, opts chatOptions, w http.ResponseWriter) {
+	results := make([]result, len(choices))
+	var wg sync.WaitGroup
+	for i, choice := range choices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = collect(choice.responseChan, opts.mode, opts.toolCallParser(), opts.outputLimits(choice.cancel))
+		}()
+	}
+	wg.Wait()
+	var response *utils.OpenAIResponse
+	var lastErr error
+	for i, result := range results {
+		if result.content == "" && result.reasoning == "" && len(result.toolCalls) == 0 && !result.cut {
+			lastErr = result.err
+			log.Printf("Failed getting response from Grok for choice %d: %v", i, result.err)
+			continue
+		}
+		if result.err != nil {
+			log.Printf("Grok response ended with error: %v", result.err)
+		}
+		if response == nil {
+			response = buildChatResponse(result, opts)
+		} else {
+			response.AddChoice(buildChatResponse(result, opts))
+		}
+	}
+	if response == nil {
+		apiErr := grokFailed(lastErr)
+		writeAPIError(w, apiErr)
+		log.Println(apiErr)
 		return
 	}
-	defer cancelFunc()
+	if result := results[0]; len(results) == 1 && result.err == nil && !result.cut && result.finishReason == "stop" {
+		opts.remember(result.content, result.conversation)
+	}
+	writeJSON(w, response)
+}
 
-	go processStreamChunk(responseChan, requestID, modelName, w, flusher, done)
-	<-done
+func buildChatResponse(result result, opts chatOptions) *utils.OpenAIResponse {
+	usage := chatUsage(opts.promptTokens, result.mode, result.content, result.toolCalls, result.reasoningTokens)
+	return utils.BuildResponse(result.content, result.reasoning, result.toolCalls, opts.requestID, opts.model, result.finishReason, usage)
 }
 
-func processStreamChunk(responseChan chan string, requestID string, model string, w http.ResponseWriter, flusher http.Flusher, done chan bool) {
-	first := false
-	for delta := range responseChan {
-		if first {
-			first = false
-			chunk := utils.BuildChunkStart(delta, requestID, model)
-			if err := sendChunk(w, flusher, chunk); err != nil {
-				log.Printf("Failed to send chunk: %v", err)
-				done <- false
-				return
-			}
-		} else {
-			chunk := utils.BuildChunk(delta, requestID, model)
-			if err := sendChunk(w, flusher, chunk); err != nil {
-				log.Printf("Failed to send chunk: %v", err)
-				done <- false
-				return
-			}
+// chatUsage estimates the usage of an answer. Reasoning counts as completion
+// tokens even when it was not sent, since Grok generated it all the same. In
+// inline mode it is already part of the content.
+func chatUsage(promptTokens int, mode string, content string, toolCalls []utils.ToolCall, reasoningTokens int) utils.OpenAIUsage {
+	completionTokens := utils.EstimateTokens(content)
+	for _, call := range toolCalls {
+		completionTokens += utils.EstimateTokens(call.Function.Name + call.Function.Arguments)
+	}
+	if mode != ReasoningInline {
+		completionTokens += reasoningTokens
+	}
+	return utils.BuildUsage(promptTokens, completionTokens, reasoningTokens)
+}
+
+// writeJSON sends a 200 response with the given body encoded as JSON.
+func writeJSON(w http.ResponseWriter, body any) {
+	responseData, err := json.Marshal(body)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to marshal response: %v", err)
+		writeError(w, errMsg, http.StatusInternalServerError)
+		log.Println(errMsg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+	log.Println("Finished sending response")
+}
+
+// processStreamChunk forwards the events of every choice as SSE chunks,
+// multiplexed by choice index. It always drains the response channels, even
+// after the client has gone away.
+func processStreamChunk(choices []grokChoice, opts chatOptions, w http.ResponseWriter, flusher http.Flusher, done chan bool) {
+	var mu sync.Mutex
+	emit := func(index int, chunk *utils.OpenAIStreamingResponseChunk) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return sendChunk(w, flusher, chunk.ForChoice(index))
+	}
+	streamed := make([]streamedChoice, len(choices))
+	var wg sync.WaitGroup
+	for i, choice := range choices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			streamed[i] = streamChoice(choice, i, opts, emit)
+		}()
+	}
+	wg.Wait()
+
+	sent, completionTokens, reasoningTokens := 0, 0, 0
+	var lastErr, streamErr error
+	for i, choice := range streamed {
+		if choice.writeErr != nil {
+			log.Printf("Failed to send chunk: %v", choice.writeErr)
+			done <- false
+			return
+		}
+		if !choice.sent {
+			log.Printf("Failed getting response from Grok for choice %d: %v", i, choice.grokErr)
+			lastErr = choice.grokErr
+			continue
+		}
+		sent++
+		if choice.grokErr != nil {
+			log.Printf("Grok response ended with error: %v", choice.grokErr)
+			streamErr = choice.grokErr
 		}
+		usage := chatUsage(0, opts.mode, choice.content, choice.toolCalls, choice.reasoningTokens)
+		completionTokens += usage.CompletionTokens
+		reasoningTokens += choice.reasoningTokens
 	}
-	if !first {
-		log.Printf("Failed getting response from Grok")
+	if sent == 0 {
+		writeAPIError(w, grokFailed(lastErr))
 		done <- false
 		return
 	}
-	finishChunk := utils.BuildChunkFinish(requestID, model)
-	if err := sendChunk(w, flusher, finishChunk); err != nil {
-		log.Printf("Failed to send chunk: %v", err)
+	if streamErr != nil {
+		if err := sendStreamError(w, flusher, toAPIError(streamErr)); err != nil {
+			log.Printf("Failed to send chunk: %v", err)
+		}
 		done <- false
 		return
 	}
+	if choice := streamed[0]; len(streamed) == 1 && !choice.cut && choice.finishReason == "stop" {
+		opts.remember(choice.content, choice.conversation)
+	}
+	if opts.includeUsage {
+		usage := utils.BuildUsage(opts.promptTokens, completionTokens, reasoningTokens)
+		if err := sendChunk(w, flusher, utils.BuildChunkUsage(opts.requestID, opts.model, usage)); err != nil {
+			log.Printf("Failed to send chunk: %v", err)
+			done <- false
+			return
+		}
+	}
 	if err := endStream(w, flusher); err != nil {
 		log.Printf("Failed to send chunk: %v", err)
 		done <- false
@@ -140,19 +493,142 @@ func processStreamChunk(responseChan chan string, requestID string, model string
 	done <- true
 }
 
+// streamedChoice is what streamChoice sent, for usage and error reporting.
+type streamedChoice struct {
+	sent            bool
+	content         string
+	toolCalls       []utils.ToolCall
+	reasoningTokens int
+	finishReason    string
+	cut             bool
+	conversation    utils.Conversation
+	grokErr         error
+	writeErr        error
+}
+
+// streamChoice sends one choice's events through emit, ending with its finish
+// chunk unless Grok failed.
+func streamChoice(choice grokChoice, index int, opts chatOptions, emit func(int, *utils.OpenAIStreamingResponseChunk) error) streamedChoice {
+	responseChan := choice.responseChan
+	defer func() {
+		for range responseChan {
+		}
+	}()
+	requestID, model := opts.requestID, opts.model
+	limits := opts.outputLimits(choice.cancel)
+	renderer := newRenderer(opts.mode)
+	tools := opts.toolCallParser()
+	first := true
+	finishReason := "stop"
+	var res streamedChoice
+	var content strings.Builder
+	send := func(delta string, reasoning string) error {
+		if delta == "" && reasoning == "" {
+			return nil
+		}
+		content.WriteString(delta)
+		var chunk *utils.OpenAIStreamingResponseChunk
+		if first {
+			first = false
+			chunk = utils.BuildChunkStart(delta, reasoning, requestID, model)
+		} else {
+			chunk = utils.BuildChunk(delta, reasoning, requestID, model)
+		}
+		return emit(index, chunk)
+	}
+	sendToolCalls := func(calls []utils.ToolCall) error {
+		if len(calls) == 0 {
+			return nil
+		}
+		first = false
+		res.toolCalls = append(res.toolCalls, calls...)
+		return emit(index, utils.BuildChunkToolCalls(calls, requestID, model))
+	}
+	// pushText sends answer text that went through the stop scanner
+	pushText := func(text string) error {
+		var calls []utils.ToolCall
+		if tools != nil {
+			text, calls = tools.push(text)
+		}
+		if err := send(renderer.render(limits.take(utils.TextEvent(text), false))); err != nil {
+			return err
+		}
+		return sendToolCalls(calls)
+	}
+	finish := func(err error) streamedChoice {
+		res.sent = !first
+		res.content = content.String()
+		res.reasoningTokens = renderer.reasoningTokens()
+		res.finishReason = finishReason
+		res.cut = limits.done()
+		res.writeErr = err
+		return res
+	}
+	for event := range responseChan {
+		if limits.done() {
+			continue
+		}
+		var err error
+		switch event.Type {
+		case utils.EventError:
+			res.grokErr = event.Err
+		case utils.EventFinish:
+			finishReason = event.FinishReason
+		case utils.EventMetadata:
+			log.Printf("Grok conversation %s, response %s", event.ConversationID, event.ResponseID)
+			res.conversation.Update(event)
+		case utils.EventText:
+			err = pushText(limits.text(event.Text))
+		default:
+			err = send(renderer.render(limits.take(event, opts.mode != ReasoningNone)))
+		}
+		if err != nil {
+			return finish(err)
+		}
+	}
+	if text := limits.flush(); text != "" {
+		if err := pushText(text); err != nil {
+			return finish(err)
+		}
+	}
+	if tools != nil && !limits.truncated() {
+		text, calls := tools.flush()
+		if err := send(renderer.render(limits.take(utils.TextEvent(text), false))); err != nil {
+			return finish(err)
+		}
+		if err := sendToolCalls(calls); err != nil {
+			return finish(err)
+		}
+	}
+	finishReason = limits.finishReason(finishReason)
+	if len(res.toolCalls) > 0 {
+		finishReason = "tool_calls"
+	}
+	if err := send(renderer.flush(), ""); err != nil {
+		return finish(err)
+	}
+	if first && limits.done() {
+		// the answer was cut before it began, which is still an answer
+		if err := emit(index, utils.BuildChunkStart("", "", requestID, model)); err != nil {
+			return finish(err)
+		}
+		first = false
+	}
+	if first || res.grokErr != nil {
+		return finish(nil)
+	}
+	return finish(emit(index, utils.BuildChunkFinish(requestID, model, finishReason)))
+}
+
 func sendChunk(w http.ResponseWriter, flusher http.Flusher, chunk *utils.OpenAIStreamingResponseChunk) error {
 	chunkData, err := json.Marshal(chunk)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to marshal chunk: %v", err)
-		http.Error(w, errMsg, http.StatusInternalServerError)
-		log.Println(errMsg)
+		log.Printf("Failed to marshal chunk: %v", err)
 		return err
 	}
 	_, err = fmt.Fprintf(w, "data: %s\n\n", chunkData)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to write chunk to response: %v", err)
-		http.Error(w, errMsg, http.StatusInternalServerError)
-		log.Println(errMsg)
+		log.Printf("Failed to write chunk to response: %v", err)
 		return err
 	}
 	flusher.Flush()
@@ -162,19 +638,23 @@ func sendChunk(w http.ResponseWriter, flusher http.Flusher, chunk *utils.OpenAIS
 func endStream(w http.ResponseWriter, flusher http.Flusher) error {
 	_, err := fmt.Fprintf(w, "data: [DONE]\n\n")
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to write end stream to response: %v", err)
-		http.Error(w, errMsg, http.StatusInternalServerError)
-		log.Println(errMsg)
+		log.Printf("Failed to write end stream to response: %v", err)
 		return err
 	}
 	flusher.Flush()
 	return nil
 }
 
-func ConfigureGrokAPI(apiFunc func(model string, prompt *string, responseChan chan string) (context.CancelFunc, error),
-	apiFuncUsingFile func(model string, prompt *string, filename string, responseChan chan string) (context.CancelFunc, error)) {
+func ConfigureGrokAPI(apiFunc func(model utils.Model, conversation *utils.Conversation, prompt *string, capture string, responseChan chan utils.Event) (context.CancelFunc, error),
+	apiFuncWithFiles func(model utils.Model, conversation *utils.Conversation, prompt *string, filenames []string, capture string, responseChan chan utils.Event) (context.CancelFunc, error)) {
 	callGrok = apiFunc
-	callGrokUsingFile = apiFuncUsingFile
+	callGrokWithFiles = apiFuncWithFiles
+}
+
+// ConfigureLocalImageDir allows image parts to refer to files under dir.
+// Local images are refused while it is empty.
+func ConfigureLocalImageDir(dir string) {
+	localImageDir = dir
 }
 
 func ConfigureExpectedAPIKey(apiKey string) {
@@ -183,15 +663,14 @@ func ConfigureExpectedAPIKey(apiKey string) {
 
 func ListModelsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	models := []string{"grok-3", "grok-3-think", "grok-3-deepsearch", "grok-3-deepersearch"}
-	modelList := utils.ModelList(models)
+	modelList := utils.ModelList(models.Listed())
 	responseData, err := json.Marshal(modelList)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to marshal model list: %v", err)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+		writeError(w, errMsg, http.StatusInternalServerError)
 		log.Println(errMsg)
 		return
 	}
@@ -202,28 +681,39 @@ func ListModelsHandler(w http.ResponseWriter, r *http.Request) {
 
 func NeedAuthorization(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if expectedAPIKey == "" {
+		if expectedAPIKey == "" && len(apiKeys) == 0 {
 			next.ServeHTTP(w, r)
 			return
 		}
 		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			// the Anthropic API sends the key in its own header
+			if apiKey := r.Header.Get("x-api-key"); apiKey != "" {
+				authHeader = "Bearer " + apiKey
+			}
+		}
 		if authHeader == "" {
 			log.Println("Auth: Missing Authorization header")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeErrorFor(w, r, newAPIError("Unauthorized", http.StatusUnauthorized))
 			return
 		}
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
 			log.Printf("Auth: Invalid Authorization header format: %s", authHeader)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeErrorFor(w, r, newAPIError("Unauthorized", http.StatusUnauthorized))
 			return
 		}
 		token := parts[1]
-		if token != expectedAPIKey {
+		if expectedAPIKey != "" && token == expectedAPIKey {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, ok := apiKeys[token]
+		if !ok {
 			log.Printf("Auth: Invalid API key: %s", token)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeErrorFor(w, r, newAPIError("Unauthorized", http.StatusUnauthorized))
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withAPIKey(r, key))
 	})
 }
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"grok-chat-proxy2/client"
+	"grok-chat-proxy2/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGrok stands in for the Grok sessions, answering every call with the
+// same events and keeping the prompts it was sent.
+type testGrok struct {
+	mu      sync.Mutex
+	events  []utils.Event
+	prompts []string
+	// cancelled counts the calls whose generation was stopped
+	cancelled int
+}
+
+// useTestGrok answers the Grok calls of the test with events, and keeps the
+// request directories in a temporary directory.
+func useTestGrok(t *testing.T, events ...utils.Event) *testGrok {
+	t.Helper()
+	grok := &testGrok{events: events}
+	savedGrok, savedGrokWithFiles := callGrok, callGrokWithFiles
+	savedDir, savedTTL, savedMax := dataDir, requestTTL, maxRequests
+	if err := ConfigureDataDir(t.TempDir(), time.Hour, 100); err != nil {
+		t.Fatal(err)
+	}
+	ConfigureGrokAPI(grok.send, func(model utils.Model, conversation *utils.Conversation, prompt *string, filenames []string, capture string, responseChan chan utils.Event) (context.CancelFunc, error) {
+		return grok.send(model, conversation, prompt, capture, responseChan)
+	})
+	t.Cleanup(func() {
+		callGrok, callGrokWithFiles = savedGrok, savedGrokWithFiles
+		dataDir, requestTTL, maxRequests = savedDir, savedTTL, savedMax
+	})
+	return grok
+}
+
+func (g *testGrok) send(model utils.Model, conversation *utils.Conversation, prompt *string, capture string, responseChan chan utils.Event) (context.CancelFunc, error) {
+	g.mu.Lock()
+	g.prompts = append(g.prompts, *prompt)
+	g.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(responseChan)
+		for _, event := range g.events {
+			select {
+			case responseChan <- event:
+			case <-ctx.Done():
+				g.mu.Lock()
+				g.cancelled++
+				g.mu.Unlock()
+				return
+			}
+		}
+	}()
+	return cancel, nil
+}
+
+func (g *testGrok) lastPrompt() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.prompts) == 0 {
+		return ""
+	}
+	return g.prompts[len(g.prompts)-1]
+}
+
+// useIdleSessions has n sessions free for the choices of the test.
+func useIdleSessions(t *testing.T, n int) {
+	saved := idleSessions
+	ConfigureIdleSessions(func() int { return n })
+	t.Cleanup(func() { idleSessions = saved })
+}
+
+// serve sends a request with the given body to the handler.
+func serve(handler http.HandlerFunc, method string, path string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+// answer is a typical Grok answer with reasoning.
+var answer = []utils.Event{
+	utils.MetadataEvent(0, "conv-1", "resp-1"),
+	utils.ReasoningEvent("Thinking it over."),
+	utils.TextEvent("Hello"),
+	utils.TextEvent(" there!"),
+	utils.FinishEvent("stop"),
+}
+
+func TestChatCompletionHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []utils.Event
+		body   string
+		status int
+		want   []string
+	}{
+		{
+			name:   "answer",
+			events: answer,
+			body:   `{"model":"grok-3","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"object":"chat.completion"`, `\u003cthink\u003e\nThinking it over.\n\u003c/think\u003e\nHello there!"`, `"finish_reason":"stop"`, `"reasoning_tokens":5`},
+		},
+		{
+			name:   "separate reasoning",
+			events: answer,
+			body:   `{"model":"grok-3","reasoning_mode":"separate","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"content":"Hello there!"`, `"reasoning_content":"Thinking it over."`},
+		},
+		{
+			name:   "stream",
+			events: answer,
+			body:   `{"model":"grok-3","stream":true,"reasoning_mode":"none","stream_options":{"include_usage":true},"messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"object":"chat.completion.chunk"`, `"content":"Hello"`, `"content":" there!"`, `"finish_reason":"stop"`, `"usage":{`, "data: [DONE]"},
+		},
+		{
+			name:   "max_tokens",
+			events: answer,
+			body:   `{"model":"grok-3","max_tokens":1,"reasoning_mode":"none","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"content":"Hello"`, `"finish_reason":"length"`},
+		},
+		{
+			name:   "stop sequence",
+			events: answer,
+			body:   `{"model":"grok-3","stop":"!","reasoning_mode":"none","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"content":"Hello there"`, `"finish_reason":"stop"`},
+		},
+		{
+			name:   "n choices",
+			events: answer,
+			body:   `{"model":"grok-3","n":2,"reasoning_mode":"none","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusOK,
+			want:   []string{`"index":0`, `"index":1`},
+		},
+		{
+			name:   "empty answer",
+			events: []utils.Event{utils.FinishEvent("stop")},
+			body:   `{"model":"grok-3","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusBadGateway,
+			want:   []string{`"code":"upstream_error"`},
+		},
+		{
+			name:   "rate limited",
+			events: []utils.Event{utils.ErrorEvent(client.ErrRateLimited)},
+			body:   `{"model":"grok-3","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusTooManyRequests,
+			want:   []string{`"code":"rate_limit_exceeded"`},
+		},
+		{
+			name:   "unknown model",
+			body:   `{"model":"gpt-0","messages":[{"role":"user","content":"Hi"}]}`,
+			status: http.StatusBadRequest,
+			want:   []string{"Unsupported model: gpt-0"},
+		},
+		{
+			name:   "invalid body",
+			body:   `{"model":`,
+			status: http.StatusBadRequest,
+			want:   []string{`"type":"invalid_request_error"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestGrok(t, tt.events...)
+			useIdleSessions(t, 2)
+			rec := serve(ChatCompletionHandler, http.MethodPost, "/v1/chat/completions", tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("missing %s in:\n%s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestChatCompletionHandlerPrompt(t *testing.T) {
+	grok := useTestGrok(t, answer...)
+	rec := serve(ChatCompletionHandler, http.MethodPost, "/v1/chat/completions", `{"model":"grok-3","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if prompt := grok.lastPrompt(); !strings.Contains(prompt, "system: Be brief.") || !strings.Contains(prompt, "human: Hi") {
+		t.Errorf("unexpected prompt %q", prompt)
+	}
+}
+
+func TestChatCompletionHandlerMethod(t *testing.T) {
+	rec := serve(ChatCompletionHandler, http.MethodGet, "/v1/chat/completions", "")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNeedAuthorization(t *testing.T) {
+	saved := expectedAPIKey
+	ConfigureExpectedAPIKey("secret")
+	t.Cleanup(func() { expectedAPIKey = saved })
+	ok := NeedAuthorization(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"bearer", "Authorization", "Bearer secret", http.StatusOK},
+		{"x-api-key", "x-api-key", "secret", http.StatusOK},
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong key", "Authorization", "Bearer nope", http.StatusUnauthorized},
+		{"wrong scheme", "Authorization", "Basic secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			ok.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("got status %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"strings"
+)
+
+// Reasoning modes select how thinking and research steps reach the client.
+const (
+	// ReasoningInline wraps reasoning in <think> or <research> tags inside the content.
+	ReasoningInline = "inline"
+	// ReasoningSeparate sends reasoning in its own field (reasoning_content).
+	ReasoningSeparate = "separate"
+	// ReasoningNone drops reasoning entirely.
+	ReasoningNone = "none"
+)
+
+var reasoningMode = ReasoningInline
+
+func ConfigureReasoningMode(mode string) error {
+	if !validReasoningMode(mode) {
+		return fmt.Errorf("unknown reasoning mode: %s", mode)
+	}
+	reasoningMode = mode
+	return nil
+}
+
+func validReasoningMode(mode string) bool {
+	return mode == ReasoningInline || mode == ReasoningSeparate || mode == ReasoningNone
+}
+
+// resolveReasoningMode returns the mode requested by the client, falling back
+// to the server default.
+func resolveReasoningMode(requested string) (string, error) {
+	if requested == "" {
+		return reasoningMode, nil
+	}
+	if !validReasoningMode(requested) {
+		return "", fmt.Errorf("unknown reasoning mode: %s", requested)
+	}
+	return requested, nil
+}
+
+// renderer turns the event stream into content and reasoning deltas according
+// to the reasoning mode.
+type renderer struct {
+	mode    string
+	current utils.EventType
+	// thought keeps the reasoning Grok generated, whatever the mode
+	thought strings.Builder
+}
+
+func newRenderer(mode string) *renderer {
+	return &renderer{mode: mode, current: utils.EventText}
+}
+
+func (r *renderer) render(event utils.Event) (content string, reasoning string) {
+	if event.Text == "" {
+		// e.g. cut by the token limit, no tag is opened for it
+		return "", ""
+	}
+	switch event.Type {
+	case utils.EventText:
+	case utils.EventReasoning, utils.EventResearch:
+		r.thought.WriteString(event.Text)
+		switch r.mode {
+		case ReasoningSeparate:
+			return "", event.Text
+		case ReasoningNone:
+			return "", ""
+		}
+	default:
+		return "", ""
+	}
+	if r.mode != ReasoningInline {
+		return event.Text, ""
+	}
+	if event.Type != r.current {
+		content += r.closeTag()
+		content += openTag(event.Type)
+		r.current = event.Type
+	}
+	return content + event.Text, ""
+}
+
+// flush closes a tag left open when the stream ends.
+func (r *renderer) flush() string {
+	content := r.closeTag()
+	r.current = utils.EventText
+	return content
+}
+
+// reasoningTokens estimates the tokens of all reasoning rendered so far.
+func (r *renderer) reasoningTokens() int {
+	return utils.EstimateTokens(r.thought.String())
+}
+
+func (r *renderer) closeTag() string {
+	switch r.current {
+	case utils.EventReasoning:
+		return "\n</think>\n"
+	case utils.EventResearch:
+		return "\n</research>\n"
+	}
+	return ""
+}
+
+func openTag(eventType utils.EventType) string {
+	switch eventType {
+	case utils.EventReasoning:
+		return "\n<think>\n"
+	case utils.EventResearch:
+		return "\n<research>\n"
+	}
+	return ""
+}
+
+// result is a whole response gathered from the event stream.
+type result struct {
+	content      string
+	reasoning    string
+	toolCalls    []utils.ToolCall
+	finishReason string
+	err          error
+	// mode is the reasoning mode the result was rendered in
+	mode            string
+	reasoningTokens int
+	// cut is set when the answer ended at a stop sequence or the token limit
+	cut bool
+	// conversation is where Grok answered
+	conversation utils.Conversation
+}
+
+// collect drains responseChan and renders everything it carried. When tools
+// is set, tool call blocks are taken out of the answer, and when limits is set
+// the answer is cut at a stop sequence or the token limit.
+func collect(responseChan chan utils.Event, mode string, tools *toolCallParser, limits *outputLimits) result {
+	renderer := newRenderer(mode)
+	var content, reasoning strings.Builder
+	res := result{finishReason: "stop", mode: mode}
+	add := func(event utils.Event) {
+		if tools != nil && event.Type == utils.EventText {
+			var calls []utils.ToolCall
+			event.Text, calls = tools.push(event.Text)
+			res.toolCalls = append(res.toolCalls, calls...)
+		}
+		contentDelta, reasoningDelta := renderer.render(limits.take(event, mode != ReasoningNone))
+		content.WriteString(contentDelta)
+		reasoning.WriteString(reasoningDelta)
+	}
+	for event := range responseChan {
+		if limits.done() {
+			continue
+		}
+		switch event.Type {
+		case utils.EventError:
+			res.err = event.Err
+		case utils.EventFinish:
+			res.finishReason = event.FinishReason
+		case utils.EventMetadata:
+			res.conversation.Update(event)
+		case utils.EventText:
+			event.Text = limits.text(event.Text)
+			add(event)
+		default:
+			add(event)
+		}
+	}
+	if text := limits.flush(); text != "" {
+		add(utils.TextEvent(text))
+	}
+	if tools != nil && !limits.truncated() {
+		text, calls := tools.flush()
+		contentDelta, _ := renderer.render(limits.take(utils.TextEvent(text), false))
+		content.WriteString(contentDelta)
+		res.toolCalls = append(res.toolCalls, calls...)
+	}
+	content.WriteString(renderer.flush())
+	res.content = content.String()
+	res.reasoning = reasoning.String()
+	res.reasoningTokens = renderer.reasoningTokens()
+	res.cut = limits.done()
+	res.finishReason = limits.finishReason(res.finishReason)
+	if len(res.toolCalls) > 0 {
+		res.content = strings.TrimSpace(res.content)
+		res.finishReason = "tool_calls"
+	}
+	return res
+}
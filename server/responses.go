@@ -0,0 +1,313 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ResponsesHandler serves the OpenAI Responses API on top of the same sessions
+// as ChatCompletionHandler.
+func ResponsesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request utils.ResponsesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errMsg := fmt.Sprintf("Failed to parse request body: %v", err)
+		writeError(w, errMsg, http.StatusBadRequest)
+		log.Println(errMsg)
+		return
+	}
+	defer r.Body.Close()
+	modelName := request.Model
+	grokModel, apiErr := resolveModel(r, modelName, request.Grok)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		log.Println(apiErr)
+		return
+	}
+
+	mode, err := resolveReasoningMode(request.ReasoningMode)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		log.Println(err)
+		return
+	}
+	if request.SummaryRequested() {
+		mode = ReasoningSeparate
+	}
+
+	msgs := request.ToMessages()
+	prompt := messagePrompt(grokModel, msgs)
+	promptTokens := utils.EstimateTokens(prompt.text)
+	responseChan, cancelFunc, err := askGrok(r.Context(), grokModel, nil, prompt, utils.MessageImages(msgs))
+	if err != nil {
+		writeAPIError(w, toAPIError(err))
+		log.Println(err)
+		return
+	}
+	defer cancelFunc()
+
+	var flusher http.Flusher
+	if request.Stream {
+		var ok bool
+		flusher, ok = startEventStream(w)
+		if !ok {
+			return
+		}
+	}
+	stream := newResponsesStream(modelName, w, flusher)
+	limits := newOutputLimits(nil, request.MaxOutputTokens, "", cancelFunc)
+	processResponsesStream(responseChan, stream, mode, promptTokens, limits)
+	if !request.Stream {
+		if stream.err != nil && len(stream.response.Output) == 0 {
+			apiErr := grokFailed(stream.err)
+			writeAPIError(w, apiErr)
+			log.Println(apiErr)
+			return
+		}
+		writeJSON(w, stream.response)
+	}
+}
+
+func processResponsesStream(responseChan chan utils.Event, stream *responsesStream, mode string, promptTokens int, limits *outputLimits) {
+	defer func() {
+		for range responseChan {
+		}
+	}()
+	if err := stream.start(); err != nil {
+		log.Printf("Failed to send event: %v", err)
+		return
+	}
+	renderer := newRenderer(mode)
+	finishReason := "stop"
+	var grokErr error
+	for event := range responseChan {
+		if limits.done() {
+			continue
+		}
+		switch event.Type {
+		case utils.EventError:
+			grokErr = event.Err
+			continue
+		case utils.EventFinish:
+			finishReason = event.FinishReason
+			continue
+		case utils.EventMetadata:
+			continue
+		}
+		content, reasoning := renderer.render(limits.take(event, mode != ReasoningNone))
+		if err := stream.add("reasoning", reasoning); err != nil {
+			log.Printf("Failed to send event: %v", err)
+			return
+		}
+		if err := stream.add("message", content); err != nil {
+			log.Printf("Failed to send event: %v", err)
+			return
+		}
+	}
+	if err := stream.add("message", renderer.flush()); err != nil {
+		log.Printf("Failed to send event: %v", err)
+		return
+	}
+	finishReason = limits.finishReason(finishReason)
+	if len(stream.response.Output) == 0 && stream.current == nil && grokErr == nil && !limits.done() {
+		grokErr = fmt.Errorf("empty response")
+	}
+	if grokErr != nil {
+		// a partial answer is kept in the failed response
+		log.Printf("Grok response ended with error: %v", grokErr)
+		if err := stream.fail(grokErr); err != nil {
+			log.Printf("Failed to send event: %v", err)
+		}
+		return
+	}
+	if err := stream.complete(finishReason, promptTokens); err != nil {
+		log.Printf("Failed to send event: %v", err)
+		return
+	}
+	log.Println("Finished sending response")
+}
+
+// responsesStream builds a Responses API object from output deltas. When a
+// flusher is given it also sends the matching semantic events as it goes.
+type responsesStream struct {
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	sequence int
+	suffix   string
+	response *utils.ResponsesResponse
+	current  *utils.ResponsesOutputItem
+	text     strings.Builder
+	// outputTokens and reasoningTokens are estimated per item as they close
+	outputTokens    int
+	reasoningTokens int
+	// err is why the response failed
+	err error
+}
+
+func newResponsesStream(model string, w http.ResponseWriter, flusher http.Flusher) *responsesStream {
+	now := time.Now()
+	suffix := fmt.Sprintf("%d", now.UnixNano())
+	return &responsesStream{
+		w:       w,
+		flusher: flusher,
+		suffix:  suffix,
+		response: &utils.ResponsesResponse{
+			ID:        "resp_" + suffix,
+			Object:    "response",
+			CreatedAt: now.Unix(),
+			Status:    "in_progress",
+			Model:     model,
+			Output:    []utils.ResponsesOutputItem{},
+		},
+	}
+}
+
+func (s *responsesStream) emit(event utils.ResponsesStreamEvent) error {
+	if s.flusher == nil {
+		return nil
+	}
+	event.SequenceNumber = s.sequence
+	s.sequence++
+	eventData, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event.Type, eventData); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *responsesStream) snapshot() *utils.ResponsesResponse {
+	response := *s.response
+	return &response
+}
+
+func (s *responsesStream) start() error {
+	if err := s.emit(utils.ResponsesStreamEvent{Type: "response.created", Response: s.snapshot()}); err != nil {
+		return err
+	}
+	return s.emit(utils.ResponsesStreamEvent{Type: "response.in_progress", Response: s.snapshot()})
+}
+
+// add appends a delta to the output item of the given type, closing the
+// current item and opening a new one when the type changes.
+func (s *responsesStream) add(itemType string, delta string) error {
+	if delta == "" {
+		return nil
+	}
+	if s.current == nil || s.current.Type != itemType {
+		if err := s.closeItem(); err != nil {
+			return err
+		}
+		if err := s.openItem(itemType); err != nil {
+			return err
+		}
+	}
+	s.text.WriteString(delta)
+	outputIndex := len(s.response.Output)
+	zero := 0
+	if itemType == "reasoning" {
+		return s.emit(utils.ResponsesStreamEvent{Type: "response.reasoning_summary_text.delta", ItemID: s.current.ID, OutputIndex: &outputIndex, SummaryIndex: &zero, Delta: delta})
+	}
+	return s.emit(utils.ResponsesStreamEvent{Type: "response.output_text.delta", ItemID: s.current.ID, OutputIndex: &outputIndex, ContentIndex: &zero, Delta: delta})
+}
+
+func (s *responsesStream) openItem(itemType string) error {
+	outputIndex := len(s.response.Output)
+	zero := 0
+	item := utils.ResponsesOutputItem{Type: itemType, ID: fmt.Sprintf("msg_%s_%d", s.suffix, outputIndex)}
+	if itemType == "reasoning" {
+		item.ID = fmt.Sprintf("rs_%s_%d", s.suffix, outputIndex)
+	} else {
+		item.Status = "in_progress"
+		item.Role = "assistant"
+	}
+	s.current = &item
+	s.text.Reset()
+	added := item
+	if err := s.emit(utils.ResponsesStreamEvent{Type: "response.output_item.added", OutputIndex: &outputIndex, Item: &added}); err != nil {
+		return err
+	}
+	if itemType == "reasoning" {
+		part := utils.ResponsesSummaryPart{Type: "summary_text", Text: ""}
+		return s.emit(utils.ResponsesStreamEvent{Type: "response.reasoning_summary_part.added", ItemID: item.ID, OutputIndex: &outputIndex, SummaryIndex: &zero, Part: part})
+	}
+	part := utils.ResponsesOutputContent{Type: "output_text", Text: "", Annotations: []any{}}
+	return s.emit(utils.ResponsesStreamEvent{Type: "response.content_part.added", ItemID: item.ID, OutputIndex: &outputIndex, ContentIndex: &zero, Part: part})
+}
+
+func (s *responsesStream) closeItem() error {
+	if s.current == nil {
+		return nil
+	}
+	item := *s.current
+	s.current = nil
+	outputIndex := len(s.response.Output)
+	zero := 0
+	text := s.text.String()
+	tokens := utils.EstimateTokens(text)
+	s.outputTokens += tokens
+	if item.Type == "reasoning" {
+		s.reasoningTokens += tokens
+		part := utils.ResponsesSummaryPart{Type: "summary_text", Text: text}
+		item.Summary = []utils.ResponsesSummaryPart{part}
+		if err := s.emit(utils.ResponsesStreamEvent{Type: "response.reasoning_summary_text.done", ItemID: item.ID, OutputIndex: &outputIndex, SummaryIndex: &zero, Text: &text}); err != nil {
+			return err
+		}
+		if err := s.emit(utils.ResponsesStreamEvent{Type: "response.reasoning_summary_part.done", ItemID: item.ID, OutputIndex: &outputIndex, SummaryIndex: &zero, Part: part}); err != nil {
+			return err
+		}
+	} else {
+		part := utils.ResponsesOutputContent{Type: "output_text", Text: text, Annotations: []any{}}
+		item.Content = []utils.ResponsesOutputContent{part}
+		item.Status = "completed"
+		if err := s.emit(utils.ResponsesStreamEvent{Type: "response.output_text.done", ItemID: item.ID, OutputIndex: &outputIndex, ContentIndex: &zero, Text: &text}); err != nil {
+			return err
+		}
+		if err := s.emit(utils.ResponsesStreamEvent{Type: "response.content_part.done", ItemID: item.ID, OutputIndex: &outputIndex, ContentIndex: &zero, Part: part}); err != nil {
+			return err
+		}
+	}
+	s.response.Output = append(s.response.Output, item)
+	return s.emit(utils.ResponsesStreamEvent{Type: "response.output_item.done", OutputIndex: &outputIndex, Item: &item})
+}
+
+func (s *responsesStream) complete(finishReason string, promptTokens int) error {
+	if err := s.closeItem(); err != nil {
+		return err
+	}
+	s.response.Usage = utils.BuildResponsesUsage(promptTokens, s.outputTokens, s.reasoningTokens)
+	eventType := "response.completed"
+	s.response.Status = "completed"
+	if finishReason == "length" {
+		eventType = "response.incomplete"
+		s.response.Status = "incomplete"
+		s.response.IncompleteDetails = &utils.ResponsesIncompleteDetails{Reason: "max_output_tokens"}
+	}
+	return s.emit(utils.ResponsesStreamEvent{Type: eventType, Response: s.snapshot()})
+}
+
+func (s *responsesStream) fail(err error) error {
+	if err := s.closeItem(); err != nil {
+		return err
+	}
+	s.err = err
+	apiErr := toAPIError(err)
+	code := apiErr.code
+	if code == "" {
+		code = apiErr.errType
+	}
+	s.response.Status = "failed"
+	s.response.Error = &utils.ResponsesError{Code: code, Message: apiErr.message}
+	return s.emit(utils.ResponsesStreamEvent{Type: "response.failed", Response: s.snapshot()})
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"grok-chat-proxy2/client"
+	"grok-chat-proxy2/utils"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResponsesHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []utils.Event
+		body   string
+		status int
+		want   []string
+	}{
+		{
+			name:   "answer",
+			events: answer,
+			body:   `{"model":"grok-3","input":"Hi"}`,
+			status: http.StatusOK,
+			want:   []string{`"object":"response"`, `"status":"completed"`, `"type":"output_text","text":"\n\u003cthink\u003e\nThinking it over.\n\u003c/think\u003e\nHello there!"`},
+		},
+		{
+			name:   "reasoning summary",
+			events: answer,
+			body:   `{"model":"grok-3","reasoning":{"summary":"auto"},"input":"Hi"}`,
+			status: http.StatusOK,
+			want:   []string{`"type":"summary_text","text":"Thinking it over."`, `"type":"output_text","text":"Hello there!"`, `"reasoning_tokens":5`},
+		},
+		{
+			name:   "stream",
+			events: answer,
+			body:   `{"model":"grok-3","stream":true,"reasoning_mode":"none","input":[{"role":"user","content":[{"type":"input_text","text":"Hi"}]}]}`,
+			status: http.StatusOK,
+			want:   []string{"event: response.created", `"type":"response.output_text.delta"`, `"delta":"Hello"`, `"delta":" there!"`, `"text":"Hello there!"`, "event: response.completed"},
+		},
+		{
+			name:   "max_output_tokens",
+			events: answer,
+			body:   `{"model":"grok-3","max_output_tokens":1,"reasoning_mode":"none","input":"Hi"}`,
+			status: http.StatusOK,
+			want:   []string{`"status":"incomplete"`, `"incomplete_details":{"reason":"max_output_tokens"}`, `"text":"Hello"`},
+		},
+		{
+			name:   "rate limited",
+			events: []utils.Event{utils.ErrorEvent(client.ErrRateLimited)},
+			body:   `{"model":"grok-3","input":"Hi"}`,
+			status: http.StatusTooManyRequests,
+			want:   []string{`"code":"rate_limit_exceeded"`},
+		},
+		{
+			name:   "failed stream",
+			events: []utils.Event{utils.TextEvent("Hello"), utils.ErrorEvent(client.ErrRateLimited)},
+			body:   `{"model":"grok-3","stream":true,"reasoning_mode":"none","input":"Hi"}`,
+			status: http.StatusOK,
+			want:   []string{`"delta":"Hello"`, "event: response.failed", `"status":"failed"`},
+		},
+		{
+			name:   "unknown model",
+			body:   `{"model":"gpt-0","input":"Hi"}`,
+			status: http.StatusBadRequest,
+			want:   []string{"Unsupported model: gpt-0"},
+		},
+		{
+			name:   "invalid body",
+			body:   `{"model":`,
+			status: http.StatusBadRequest,
+			want:   []string{`"type":"invalid_request_error"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestGrok(t, tt.events...)
+			rec := serve(ResponsesHandler, http.MethodPost, "/v1/responses", tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("missing %s in:\n%s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestResponsesHandlerPrompt(t *testing.T) {
+	grok := useTestGrok(t, answer...)
+	rec := serve(ResponsesHandler, http.MethodPost, "/v1/responses", `{"model":"grok-3","instructions":"Be brief.","input":[{"role":"user","content":"Hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if prompt := grok.lastPrompt(); !strings.Contains(prompt, "Be brief.") || !strings.Contains(prompt, "human: Hi") {
+		t.Errorf("unexpected prompt %q", prompt)
+	}
+}
+
+func TestResponsesHandlerMethod(t *testing.T) {
+	rec := serve(ResponsesHandler, http.MethodGet, "/v1/responses", "")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
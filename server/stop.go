@@ -0,0 +1,61 @@
+package server
+
+import "strings"
+
+// stopScanner cuts the output at the first stop sequence. It holds back the
+// end of the text that could still be the start of a stop sequence, so that
+// matches split across deltas are caught as well.
+type stopScanner struct {
+	stops   []string
+	pending string
+	stopped bool
+	// matched is the stop sequence the output was cut at
+	matched string
+}
+
+func newStopScanner(stops []string) *stopScanner {
+	var nonEmpty []string
+	for _, stop := range stops {
+		if stop != "" {
+			nonEmpty = append(nonEmpty, stop)
+		}
+	}
+	return &stopScanner{stops: nonEmpty}
+}
+
+// push returns the part of delta that can be sent, and whether a stop
+// sequence was found. Once stopped, everything is swallowed.
+func (s *stopScanner) push(delta string) (string, bool) {
+	if s.stopped {
+		return "", true
+	}
+	if len(s.stops) == 0 {
+		return delta, false
+	}
+	text := s.pending + delta
+	cut := -1
+	for _, stop := range s.stops {
+		if i := strings.Index(text, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+			s.matched = stop
+		}
+	}
+	if cut >= 0 {
+		s.stopped = true
+		s.pending = ""
+		return text[:cut], true
+	}
+	hold := 0
+	for _, stop := range s.stops {
+		hold = max(hold, partialSuffix(text, stop))
+	}
+	s.pending = text[len(text)-hold:]
+	return text[:len(text)-hold], false
+}
+
+// flush returns the text held back when the output ends without a match.
+func (s *stopScanner) flush() string {
+	pending := s.pending
+	s.pending = ""
+	return pending
+}
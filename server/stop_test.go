@@ -0,0 +1,39 @@
+package server
+
+import "testing"
+
+func TestStopScanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		stops   []string
+		deltas  []string
+		want    string
+		stopped bool
+		matched string
+	}{
+		{"no stops", nil, []string{"Hello", " world"}, "Hello world", false, ""},
+		{"empty stops are ignored", []string{""}, []string{"Hello"}, "Hello", false, ""},
+		{"match in one delta", []string{"END"}, []string{"Hello END world"}, "Hello ", true, "END"},
+		{"match split across deltas", []string{"END"}, []string{"Hello E", "N", "D world"}, "Hello ", true, "END"},
+		{"partial match is released", []string{"END"}, []string{"Hello EN", "d"}, "Hello ENd", false, ""},
+		{"earliest of several stops", []string{"world", "lo"}, []string{"Hello world"}, "Hel", true, "lo"},
+		{"nothing after the match", []string{"\n\n"}, []string{"one\n", "\ntwo", " three"}, "one", true, "\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStopScanner(tt.stops)
+			got, stopped := "", false
+			for _, delta := range tt.deltas {
+				var text string
+				text, stopped = s.push(delta)
+				got += text
+			}
+			if !stopped {
+				got += s.flush()
+			}
+			if got != tt.want || stopped != tt.stopped || s.matched != tt.matched {
+				t.Errorf("got %q, stopped %v at %q; want %q, stopped %v at %q", got, stopped, s.matched, tt.want, tt.stopped, tt.matched)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"log"
+	"strings"
+	"time"
+)
+
+// toolCallParser pulls <tool_call> blocks out of Grok's answer. Text outside
+// the blocks is passed through; the end of a delta that could be the start of
+// a block is held back until the next one.
+type toolCallParser struct {
+	prefix  string
+	pending string
+	inCall  bool
+	calls   int
+}
+
+func newToolCallParser() *toolCallParser {
+	return &toolCallParser{prefix: fmt.Sprintf("call_%d", time.Now().UnixNano())}
+}
+
+func (p *toolCallParser) push(delta string) (string, []utils.ToolCall) {
+	text := p.pending + delta
+	p.pending = ""
+	var content strings.Builder
+	var calls []utils.ToolCall
+	for text != "" {
+		if p.inCall {
+			end := strings.Index(text, utils.ToolCallCloseTag)
+			if end < 0 {
+				p.pending = text
+				break
+			}
+			content.WriteString(p.parse(text[:end], &calls))
+			text = text[end+len(utils.ToolCallCloseTag):]
+			p.inCall = false
+			continue
+		}
+		start := strings.Index(text, utils.ToolCallOpenTag)
+		if start < 0 {
+			hold := partialSuffix(text, utils.ToolCallOpenTag)
+			content.WriteString(text[:len(text)-hold])
+			p.pending = text[len(text)-hold:]
+			break
+		}
+		content.WriteString(text[:start])
+		text = text[start+len(utils.ToolCallOpenTag):]
+		p.inCall = true
+	}
+	return content.String(), calls
+}
+
+// flush handles what is left when the answer ends, including a last block
+// whose closing tag Grok left out.
+func (p *toolCallParser) flush() (string, []utils.ToolCall) {
+	text := p.pending
+	p.pending = ""
+	if !p.inCall {
+		return text, nil
+	}
+	p.inCall = false
+	var calls []utils.ToolCall
+	content := p.parse(text, &calls)
+	return content, calls
+}
+
+// parse turns a block body into a call. A body that is not a valid call is
+// given back as text so nothing is lost.
+func (p *toolCallParser) parse(body string, calls *[]utils.ToolCall) string {
+	function, err := utils.ParseToolCall(body)
+	if err != nil {
+		log.Printf("Failed to parse tool call: %v", err)
+		return utils.ToolCallOpenTag + body + utils.ToolCallCloseTag
+	}
+	index := p.calls
+	p.calls++
+	*calls = append(*calls, utils.ToolCall{
+		Index:    &index,
+		ID:       fmt.Sprintf("%s_%d", p.prefix, index),
+		Type:     "function",
+		Function: *function,
+	})
+	return ""
+}
+
+// partialSuffix returns the length of the longest end of text that is a
+// proper prefix of tag.
+func partialSuffix(text string, tag string) int {
+	for k := min(len(tag)-1, len(text)); k > 0; k-- {
+		if strings.HasSuffix(text, tag[:k]) {
+			return k
+		}
+	}
+	return 0
+}
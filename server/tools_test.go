@@ -0,0 +1,90 @@
+package server
+
+import (
+	"grok-chat-proxy2/utils"
+	"testing"
+)
+
+func TestToolCallParser(t *testing.T) {
+	type call struct{ name, arguments string }
+	tests := []struct {
+		name   string
+		deltas []string
+		text   string
+		calls  []call
+	}{
+		{
+			name:   "plain text",
+			deltas: []string{"Hello ", "world"},
+			text:   "Hello world",
+		},
+		{
+			name:   "one call",
+			deltas: []string{"<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call>"},
+			calls:  []call{{"get_weather", `{"city":"Paris"}`}},
+		},
+		{
+			name:   "tags split across deltas",
+			deltas: []string{"Let me check.\n<tool", "_call>{\"name\": \"a\", \"argu", "ments\": {}}</tool", "_call>"},
+			text:   "Let me check.\n",
+			calls:  []call{{"a", "{}"}},
+		},
+		{
+			name:   "two calls",
+			deltas: []string{"<tool_call>{\"name\": \"a\"}</tool_call>\n<tool_call>{\"name\": \"b\", \"arguments\": \"{\\\"x\\\":1}\"}</tool_call>"},
+			text:   "\n",
+			calls:  []call{{"a", "{}"}, {"b", `{"x":1}`}},
+		},
+		{
+			name:   "code fence around the call",
+			deltas: []string{"<tool_call>\n```json\n{\"name\": \"a\", \"arguments\": {\"n\": 2}}\n```\n</tool_call>"},
+			calls:  []call{{"a", `{"n":2}`}},
+		},
+		{
+			name:   "missing closing tag",
+			deltas: []string{"<tool_call>{\"name\": \"a\", \"arguments\": {}}"},
+			calls:  []call{{"a", "{}"}},
+		},
+		{
+			name:   "invalid call is kept as text",
+			deltas: []string{"<tool_call>not json</tool_call>"},
+			text:   "<tool_call>not json</tool_call>",
+		},
+		{
+			name:   "partial tag at the end is released",
+			deltas: []string{"a <tool"},
+			text:   "a <tool",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newToolCallParser()
+			text := ""
+			var calls []utils.ToolCall
+			for _, delta := range tt.deltas {
+				content, got := p.push(delta)
+				text += content
+				calls = append(calls, got...)
+			}
+			content, got := p.flush()
+			text += content
+			calls = append(calls, got...)
+			if text != tt.text {
+				t.Errorf("text %q, want %q", text, tt.text)
+			}
+			if len(calls) != len(tt.calls) {
+				t.Fatalf("got %d calls, want %d: %+v", len(calls), len(tt.calls), calls)
+			}
+			ids := map[string]bool{}
+			for i, c := range calls {
+				if c.Function.Name != tt.calls[i].name || c.Function.Arguments != tt.calls[i].arguments {
+					t.Errorf("call %d is %s(%s), want %s(%s)", i, c.Function.Name, c.Function.Arguments, tt.calls[i].name, tt.calls[i].arguments)
+				}
+				if c.Index == nil || *c.Index != i || c.Type != "function" || ids[c.ID] {
+					t.Errorf("call %d has index %v, type %q and id %q", i, c.Index, c.Type, c.ID)
+				}
+				ids[c.ID] = true
+			}
+		})
+	}
+}
@@ -0,0 +1,675 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"grok-chat-proxy2/utils"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTranscriptResponse is how much of a response body is archived, and
+// maxTranscriptRequest how large a request body is read for the archive.
+const (
+	maxTranscriptResponse = 1 << 20
+	maxTranscriptRequest  = 64 << 20
+)
+
+// replayContextKey marks a request made by ReplayHandler with the ID of the
+// request it replays. It is only set from the context, so that clients cannot
+// claim to be replays.
+type replayContextKey struct{}
+
+// transcriptStore keeps the archived requests in a JSONL file, with an index
+// of where each one is, so that a request is read without going through the
+// others and the list needs no reading at all. It keeps the requests as long
+// as the request directories are kept, see ConfigureDataDir.
+type transcriptStore struct {
+	mu   sync.RWMutex
+	path string
+	// index holds the archived requests by the time they were received. The
+	// file is in the order they were archived, which differs when a request
+	// is archived after a later one ended.
+	index []transcriptEntry
+	byID  map[string]int
+	size  int64
+}
+
+// transcriptEntry is where an archived request is in the file, with what it
+// is listed and filtered by.
+type transcriptEntry struct {
+	transcriptSummary
+	offset int64
+	length int64
+}
+
+var transcripts = &transcriptStore{byID: map[string]int{}}
+
+// replayTarget serves replayed requests, see ConfigureReplay.
+var replayTarget http.Handler
+
+// ConfigureTranscripts archives the requests in the file at path, indexing
+// what it already holds. Nothing is archived while path is empty.
+func ConfigureTranscripts(path string) error {
+	s := transcripts
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	s.index, s.byID, s.size = nil, map[string]int{}, 0
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a last line without its newline was cut short when writing
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var t transcript
+		if err := json.Unmarshal(line, &t); err != nil {
+			log.Printf("Skipping a damaged request in %s: %v", path, err)
+		} else {
+			s.add(t.summary(), s.size, int64(len(line)))
+		}
+		s.size += int64(len(line))
+	}
+	if err := os.Truncate(path, s.size); err != nil {
+		return err
+	}
+	s.prune(true)
+	log.Printf("Loaded %d archived requests from %s", len(s.index), path)
+	return nil
+}
+
+// ConfigureReplay sets the handler that replayed requests are sent through,
+// the one serving the APIs.
+func ConfigureReplay(handler http.Handler) {
+	replayTarget = handler
+}
+
+// transcript is the archived record of a request.
+type transcript struct {
+	ID       string    `json:"id"`
+	ReplayOf string    `json:"replay_of,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_ms"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	// APIKey is masked, it is only kept to tell the callers apart
+	APIKey string `json:"api_key,omitempty"`
+	Model  string `json:"model,omitempty"`
+	// Request is the body when it is JSON, RequestText when it is not
+	Request     json.RawMessage `json:"request,omitempty"`
+	RequestText string          `json:"request_text,omitempty"`
+	Status      int             `json:"status"`
+	// Response is the body as sent, streams included
+	Response string            `json:"response"`
+	Error    string            `json:"error,omitempty"`
+	Calls    []*callTranscript `json:"calls,omitempty"`
+}
+
+func (t *transcript) summary() transcriptSummary {
+	return transcriptSummary{
+		ID: t.ID, ReplayOf: t.ReplayOf, Time: t.Time, Duration: t.Duration,
+		Method: t.Method, Path: t.Path, APIKey: t.APIKey, Model: t.Model,
+		Status: t.Status, Error: t.Error, Calls: len(t.Calls),
+	}
+}
+
+// callTranscript is one Grok call made for a request.
+type callTranscript struct {
+	mu             sync.Mutex
+	Model          string    `json:"model"`
+	Prompt         string    `json:"prompt"`
+	Attachments    []string  `json:"attachments,omitempty"`
+	Session        *int      `json:"session,omitempty"`
+	ConversationID string    `json:"conversation_id,omitempty"`
+	Started        time.Time `json:"started"`
+	Duration       float64   `json:"duration_ms"`
+	Error          string    `json:"error,omitempty"`
+	// Raw are the NDJSON lines Grok streamed
+	Raw []string `json:"raw,omitempty"`
+	// capture is the file the raw lines were written to
+	capture string
+	// done tells the request the call is over, see end
+	done func()
+	once sync.Once
+}
+
+// recordingWriter keeps a copy of what is written to the client.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := maxTranscriptResponse - w.body.Len(); room > 0 {
+		w.body.Write(data[:min(room, len(data))])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// startTranscript records what is known of the request before it is served.
+// The body is read and put back for the handler. It returns nil when nothing
+// is archived, and an error when the body cannot be read.
+func startTranscript(id string, w http.ResponseWriter, r *http.Request) (*transcript, error) {
+	if transcripts.path == "" {
+		return nil, nil
+	}
+	replayOf, _ := r.Context().Value(replayContextKey{}).(string)
+	record := &transcript{
+		ID:       id,
+		ReplayOf: replayOf,
+		Time:     time.Now(),
+		Method:   r.Method,
+		Path:     r.URL.RequestURI(),
+		APIKey:   maskKey(requestToken(r)),
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTranscriptRequest))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if json.Valid(body) {
+		record.Request = body
+		var probe struct {
+			Model string `json:"model"`
+		}
+		if json.Unmarshal(body, &probe) == nil {
+			record.Model = probe.Model
+		}
+	} else {
+		record.RequestText = string(body)
+	}
+	return record, nil
+}
+
+// served completes the record with the response, once the handler returned.
+func (t *transcript) served(w *recordingWriter) {
+	t.Duration = milliseconds(time.Since(t.Time))
+	t.Status = w.status
+	if t.Status == 0 {
+		t.Status = http.StatusOK
+	}
+	t.Response = w.body.String()
+	if t.Status >= 400 {
+		t.Error = errorMessage(w.body.Bytes())
+	}
+}
+
+// archive adds the Grok calls to the record and archives it. It waits for the
+// calls to end first, since the handler may return while Grok is still
+// streaming an answer that was cut or abandoned, or the other choices.
+func (t *transcript) archive(dir *requestDir) {
+	dir.pending.Wait()
+	dir.mu.Lock()
+	calls := slices.Clone(dir.calls)
+	dir.mu.Unlock()
+	for _, call := range calls {
+		snapshot := call.snapshot()
+		if t.Error == "" {
+			t.Error = snapshot.Error
+		}
+		t.Calls = append(t.Calls, snapshot)
+	}
+	if err := transcripts.append(t); err != nil {
+		log.Printf("Failed to archive request %s: %v", t.ID, err)
+	}
+}
+
+// snapshot copies the call with the lines captured from Grok.
+func (c *callTranscript) snapshot() *callTranscript {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &callTranscript{
+		Model:          c.Model,
+		Prompt:         c.Prompt,
+		Attachments:    c.Attachments,
+		Session:        c.Session,
+		ConversationID: c.ConversationID,
+		Started:        c.Started,
+		Duration:       c.Duration,
+		Error:          c.Error,
+		Raw:            readLines(c.capture),
+	}
+}
+
+// end marks the call as over, once its events have all been read or when it
+// failed to start.
+func (c *callTranscript) end() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.Duration = milliseconds(time.Since(c.Started))
+		c.mu.Unlock()
+		c.done()
+	})
+}
+
+// observe notes the session, conversation and errors of the call from the
+// events passing through, and ends the call once they stop.
+func (c *callTranscript) observe(responseChan chan utils.Event) chan utils.Event {
+	observed := make(chan utils.Event, cap(responseChan))
+	go func() {
+		defer close(observed)
+		for event := range responseChan {
+			c.mu.Lock()
+			switch event.Type {
+			case utils.EventMetadata:
+				session := event.Session
+				c.Session = &session
+				c.ConversationID = event.ConversationID
+			case utils.EventError:
+				c.Error = event.Err.Error()
+			}
+			c.mu.Unlock()
+			observed <- event
+		}
+		c.end()
+	}()
+	return observed
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// requestToken returns the API key sent with the request, if any.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.Header.Get("x-api-key")
+}
+
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+// errorMessage takes the message out of an error body in any of the API
+// formats, or returns the body as it is.
+func errorMessage(body []byte) string {
+	var nested struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &nested) == nil && nested.Error.Message != "" {
+		return nested.Error.Message
+	}
+	var flat struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &flat) == nil && flat.Error != "" {
+		return flat.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+func readLines(path string) []string {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func (s *transcriptStore) append(t *transcript) error {
+	line, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	f.Close()
+	if err != nil {
+		// drop what was written of the line, the index ends before it
+		os.Truncate(s.path, s.size)
+		return err
+	}
+	s.add(t.summary(), s.size, int64(len(line)))
+	s.size += int64(len(line))
+	s.prune(false)
+	return nil
+}
+
+// add indexes a request. The caller holds the lock.
+func (s *transcriptStore) add(summary transcriptSummary, offset int64, length int64) {
+	i := len(s.index)
+	for i > 0 && s.index[i-1].Time.After(summary.Time) {
+		i--
+	}
+	s.index = slices.Insert(s.index, i, transcriptEntry{transcriptSummary: summary, offset: offset, length: length})
+	for ; i < len(s.index); i++ {
+		s.byID[s.index[i].ID] = i
+	}
+}
+
+// prune drops the requests past the retention of the request directories by
+// writing the file anew without them, in the order they were received. Unless force is set, that waits until
+// a tenth of the requests kept can go, so the file is not rewritten for every
+// new request. The caller holds the lock.
+func (s *transcriptStore) prune(force bool) {
+	drop := max(0, len(s.index)-maxRequests)
+	for drop < len(s.index) && time.Since(s.index[drop].Time) > requestTTL {
+		drop++
+	}
+	if drop == 0 || (!force && drop < max(1, maxRequests/10)) {
+		return
+	}
+	kept := s.index[drop:]
+	if err := s.rewrite(kept); err != nil {
+		log.Printf("Failed to prune %s: %v", s.path, err)
+		return
+	}
+	s.index, s.byID, s.size = nil, map[string]int{}, 0
+	for _, entry := range kept {
+		s.add(entry.transcriptSummary, s.size, entry.length)
+		s.size += entry.length
+	}
+	log.Printf("Removed %d archived requests", drop)
+}
+
+// rewrite replaces the file with one holding only the given requests.
+func (s *transcriptStore) rewrite(entries []transcriptEntry) error {
+	src, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range entries {
+		if _, err := io.Copy(writer, io.NewSectionReader(src, entry.offset, entry.length)); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// read loads an indexed request from the file. The caller holds the lock.
+func (s *transcriptStore) read(f *os.File, entry transcriptEntry) (*transcript, error) {
+	line := make([]byte, entry.length)
+	if _, err := f.ReadAt(line, entry.offset); err != nil {
+		return nil, fmt.Errorf("failed to read request %s from %s: %v", entry.ID, s.path, err)
+	}
+	var t transcript
+	if err := json.Unmarshal(line, &t); err != nil {
+		return nil, fmt.Errorf("failed to parse request %s in %s: %v", entry.ID, s.path, err)
+	}
+	return &t, nil
+}
+
+// find returns the archived request with the given ID, nil when there is
+// none.
+func (s *transcriptStore) find(id string) (*transcript, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byID[id]
+	if !ok {
+		return nil, nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return s.read(f, s.index[i])
+}
+
+// list returns the summaries of the requests matching the filter, newest
+// first and at most limit of them, and how many match in all. Only a text
+// query reads the requests from the file.
+func (s *transcriptStore) list(filter transcriptFilter, limit int) ([]transcriptSummary, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var f *os.File
+	if filter.query != "" && len(s.index) > 0 {
+		var err error
+		if f, err = os.Open(s.path); err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+	}
+	summaries := []transcriptSummary{}
+	total := 0
+	for i := len(s.index) - 1; i >= 0; i-- {
+		entry := s.index[i]
+		if !filter.matches(entry.transcriptSummary) {
+			continue
+		}
+		if filter.query != "" {
+			t, err := s.read(f, entry)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !filter.contains(t) {
+				continue
+			}
+		}
+		total++
+		if len(summaries) < limit {
+			summaries = append(summaries, entry.transcriptSummary)
+		}
+	}
+	return summaries, total, nil
+}
+
+// transcriptFilter selects archived requests by the query parameters of the
+// admin endpoint.
+type transcriptFilter struct {
+	query  string
+	model  string
+	path   string
+	status int
+	failed bool
+}
+
+// matches tells whether the listed fields of a request pass the filter.
+func (f transcriptFilter) matches(t transcriptSummary) bool {
+	if f.model != "" && !strings.EqualFold(t.Model, f.model) {
+		return false
+	}
+	if f.path != "" && !strings.HasPrefix(t.Path, f.path) {
+		return false
+	}
+	if f.status != 0 && t.Status != f.status {
+		return false
+	}
+	return !f.failed || t.Error != ""
+}
+
+// contains tells whether the request holds the text query of the filter.
+func (f transcriptFilter) contains(t *transcript) bool {
+	texts := []string{string(t.Request), t.RequestText, t.Response, t.Error}
+	for _, call := range t.Calls {
+		texts = append(texts, call.Prompt, call.ConversationID)
+	}
+	for _, text := range texts {
+		if strings.Contains(strings.ToLower(text), f.query) {
+			return true
+		}
+	}
+	return false
+}
+
+// transcriptSummary is a request as listed, without its bodies.
+type transcriptSummary struct {
+	ID       string    `json:"id"`
+	ReplayOf string    `json:"replay_of,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_ms"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	APIKey   string    `json:"api_key,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Status   int       `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Calls    int       `json:"calls"`
+}
+
+// RequestsHandler lists the archived requests, newest first, or shows one
+// with the id query parameter. The list is narrowed by q (text in the request,
+// prompts, response or error), model, path, status and failed=1, and holds at
+// most limit entries, 50 by default.
+func RequestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if id := query.Get("id"); id != "" {
+		t, err := transcripts.find(id)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if t == nil {
+			writeError(w, fmt.Sprintf("No request %s in the archive", id), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, t)
+		return
+	}
+	filter := transcriptFilter{
+		query:  strings.ToLower(query.Get("q")),
+		model:  query.Get("model"),
+		path:   query.Get("path"),
+		failed: query.Get("failed") == "1" || query.Get("failed") == "true",
+	}
+	limit := 50
+	for name, value := range map[string]*int{"status": &filter.status, "limit": &limit} {
+		if text := query.Get(name); text != "" {
+			n, err := strconv.Atoi(text)
+			if err != nil || n < 0 {
+				writeError(w, fmt.Sprintf("Invalid %s: %s", name, text), http.StatusBadRequest)
+				return
+			}
+			*value = n
+		}
+	}
+	summaries, total, err := transcripts.list(filter, limit)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	writeJSON(w, map[string]any{"requests": summaries, "total": total})
+}
+
+// ReplayHandler sends the archived request with the given id again, through
+// the current models, templates and sessions, and answers with its response.
+// The replay is authorized with the caller's key, not the original one, and
+// is archived as a new request that refers to the old one.
+func ReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	if replayTarget == nil {
+		writeError(w, "Replay is not configured", http.StatusInternalServerError)
+		return
+	}
+	t, err := transcripts.find(id)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if t == nil {
+		writeError(w, fmt.Sprintf("No request %s in the archive", id), http.StatusNotFound)
+		return
+	}
+	body := []byte(t.Request)
+	if len(body) == 0 {
+		body = []byte(t.RequestText)
+	}
+	ctx := context.WithValue(r.Context(), replayContextKey{}, id)
+	replay, err := http.NewRequestWithContext(ctx, t.Method, t.Path, bytes.NewReader(body))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to rebuild request %s: %v", id, err)
+		writeError(w, errMsg, http.StatusInternalServerError)
+		log.Println(errMsg)
+		return
+	}
+	replay.Header.Set("Content-Type", "application/json")
+	for _, name := range []string{"Authorization", "x-api-key"} {
+		if value := r.Header.Get(name); value != "" {
+			replay.Header.Set(name, value)
+		}
+	}
+	log.Printf("Replaying request %s: %s %s", id, t.Method, t.Path)
+	replayTarget.ServeHTTP(w, replay)
+}
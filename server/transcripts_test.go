@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestArchive archives into a new file, keeping at most max requests for
+// ttl, until the test ends.
+func useTestArchive(t *testing.T, max int, ttl time.Duration) string {
+	t.Helper()
+	savedTTL, savedMax := requestTTL, maxRequests
+	requestTTL, maxRequests = ttl, max
+	path := filepath.Join(t.TempDir(), "transcripts.jsonl")
+	if err := ConfigureTranscripts(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ConfigureTranscripts("")
+		requestTTL, maxRequests = savedTTL, savedMax
+	})
+	return path
+}
+
+func testTranscript(id string, age time.Duration) *transcript {
+	return &transcript{ID: id, Time: time.Now().Add(-age), Method: "POST", Path: "/v1/chat/completions", Model: "grok-3", Status: 200, Response: "answer of " + id}
+}
+
+func listedIDs(t *testing.T, filter transcriptFilter, limit int) ([]string, int) {
+	t.Helper()
+	summaries, total, err := transcripts.list(filter, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, summary := range summaries {
+		ids = append(ids, summary.ID)
+	}
+	return ids, total
+}
+
+func TestTranscriptStoreIndex(t *testing.T) {
+	path := useTestArchive(t, 100, time.Hour)
+	for i, age := range []time.Duration{3, 1, 2} {
+		record := testTranscript(fmt.Sprintf("req_%d", i), age*time.Minute)
+		if i == 1 {
+			record.Status, record.Error, record.Response = 502, "Grok failed", "needle"
+		}
+		if err := transcripts.append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(t *testing.T) {
+		// newest first, whatever order they were archived in
+		if ids, total := listedIDs(t, transcriptFilter{}, 10); !slices.Equal(ids, []string{"req_1", "req_2", "req_0"}) || total != 3 {
+			t.Errorf("listed %v of %d", ids, total)
+		}
+		if ids, total := listedIDs(t, transcriptFilter{}, 1); len(ids) != 1 || total != 3 {
+			t.Errorf("listed %v of %d with a limit of 1", ids, total)
+		}
+		if ids, _ := listedIDs(t, transcriptFilter{failed: true}, 10); !slices.Equal(ids, []string{"req_1"}) {
+			t.Errorf("failed requests are %v", ids)
+		}
+		if ids, _ := listedIDs(t, transcriptFilter{query: "needle"}, 10); !slices.Equal(ids, []string{"req_1"}) {
+			t.Errorf("requests holding the query are %v", ids)
+		}
+		for _, id := range []string{"req_0", "req_1", "req_2"} {
+			record, err := transcripts.find(id)
+			if err != nil || record == nil || record.ID != id {
+				t.Errorf("find(%s) = %v, %v", id, record, err)
+			}
+		}
+		if record, err := transcripts.find("req_9"); record != nil || err != nil {
+			t.Errorf("find of a missing request = %v, %v", record, err)
+		}
+	}
+	check(t)
+
+	// a damaged line is skipped and a partly written last line dropped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n{\"id\":\"req_")
+	f.Close()
+	if err := ConfigureTranscripts(path); err != nil {
+		t.Fatal(err)
+	}
+	check(t)
+	data, _ := os.ReadFile(path)
+	if !strings.HasSuffix(string(data), "\n") {
+		t.Error("the partial line was left in the file")
+	}
+}
+
+func TestTranscriptStorePrune(t *testing.T) {
+	path := useTestArchive(t, 10, time.Hour)
+	// archived out of order, as requests end in a different order than they
+	// start; req_0 is the oldest and archived last
+	for i := 1; i <= 10; i++ {
+		if err := transcripts.append(testTranscript(fmt.Sprintf("req_%d", i), time.Duration(20-i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := transcripts.append(testTranscript("req_0", 30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	ids, total := listedIDs(t, transcriptFilter{}, 100)
+	if total != 10 || slices.Contains(ids, "req_0") || !slices.Contains(ids, "req_1") {
+		t.Errorf("kept %v, want req_1 to req_10", ids)
+	}
+	for _, id := range ids {
+		if record, err := transcripts.find(id); err != nil || record == nil || record.ID != id {
+			t.Errorf("find(%s) after pruning = %v, %v", id, record, err)
+		}
+	}
+
+	// requests past the ttl are dropped when the archive is loaded
+	requestTTL = 15 * time.Minute
+	if err := ConfigureTranscripts(path); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := listedIDs(t, transcriptFilter{}, 100); !slices.Equal(ids, []string{"req_10", "req_9", "req_8", "req_7", "req_6"}) {
+		t.Errorf("kept %v after the ttl", ids)
+	}
+}
+
+func TestRequestsHandler(t *testing.T) {
+	useTestArchive(t, 100, time.Hour)
+	transcripts.append(testTranscript("req_1", time.Minute))
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, `"total":1`},
+		{"?id=req_1", http.StatusOK, `"response":"answer of req_1"`},
+		{"?id=req_2", http.StatusNotFound, "No request req_2"},
+		{"?limit=x", http.StatusBadRequest, "Invalid limit"},
+		{"?model=grok-4", http.StatusOK, `"total":0`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			RequestsHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/requests"+tt.query, nil))
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("got %d %s, want %d with %s", rec.Code, rec.Body.String(), tt.status, tt.body)
+			}
+		})
+	}
+}
+
+// waitArchived returns the archived request with the given id, waiting for
+// its Grok calls to end.
+func waitArchived(t *testing.T, id string) *transcript {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		record, err := transcripts.find(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record != nil {
+			return record
+		}
+	}
+	t.Fatalf("request %s was not archived", id)
+	return nil
+}
+
+func TestWithRequestID(t *testing.T) {
+	useTestGrok(t, answer...)
+	useTestArchive(t, 100, time.Hour)
+	savedKey := expectedAPIKey
+	ConfigureExpectedAPIKey("secret")
+	mux := http.NewServeMux()
+	mux.Handle("/v1/chat/completions", NeedAuthorization(WithRequestID(http.HandlerFunc(ChatCompletionHandler))))
+	mux.Handle("/admin/requests/replay", NeedAdmin(http.HandlerFunc(ReplayHandler)))
+	ConfigureReplay(mux)
+	t.Cleanup(func() {
+		expectedAPIKey = savedKey
+		ConfigureReplay(nil)
+	})
+	send := func(path string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		// only ReplayHandler marks replays, clients cannot
+		req.Header.Set("X-Replay-Of", "req_forged")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	body := `{"model":"grok-3","reasoning_mode":"none","messages":[{"role":"user","content":"Hi"}]}`
+
+	if rec := send("/v1/chat/completions", "wrong", body); rec.Code != http.StatusUnauthorized || rec.Header().Get("X-Request-Id") != "" {
+		t.Errorf("unauthorized request got %d with id %q", rec.Code, rec.Header().Get("X-Request-Id"))
+	}
+	rec := send("/v1/chat/completions", "secret", body)
+	id := rec.Header().Get("X-Request-Id")
+	if rec.Code != http.StatusOK || id == "" {
+		t.Fatalf("got %d with id %q: %s", rec.Code, id, rec.Body.String())
+	}
+	record := waitArchived(t, id)
+	if record.ReplayOf != "" || record.Model != "grok-3" || record.Status != http.StatusOK || len(record.Calls) != 1 || !strings.Contains(record.Response, "Hello there!") {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	rec = send("/admin/requests/replay?id="+id, "secret", "")
+	replayID := rec.Header().Get("X-Request-Id")
+	if rec.Code != http.StatusOK || replayID == "" || replayID == id {
+		t.Fatalf("replay got %d with id %q: %s", rec.Code, replayID, rec.Body.String())
+	}
+	if replay := waitArchived(t, replayID); replay.ReplayOf != id {
+		t.Errorf("replay archived as a replay of %q, want %q", replay.ReplayOf, id)
+	}
+	if _, total := listedIDs(t, transcriptFilter{}, 10); total != 2 {
+		t.Errorf("archived %d requests, want the request and its replay", total)
+	}
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every request gets its own directory under dataDir/requests for the files of
+// its Grok calls: the prompt, the raw answer stream and the uploads. The
+// directories of old requests are removed as new ones are made.
+var (
+	dataDir     = "data"
+	requestTTL  = 24 * time.Hour
+	maxRequests = 100
+	pruneMu     sync.Mutex
+)
+
+// ConfigureDataDir sets where the request directories are kept, and for how
+// long: a directory is removed once it is older than ttl, or when there are
+// more than max newer ones. The dir is made absolute, as the uploads in it are
+// handed to the browser.
+func ConfigureDataDir(dir string, ttl time.Duration, max int) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	dataDir = abs
+	requestTTL = ttl
+	maxRequests = max
+	if err := os.MkdirAll(filepath.Join(dataDir, "requests"), 0755); err != nil {
+		return err
+	}
+	pruneRequestDirs("")
+	return nil
+}
+
+// requestDir is the directory of a request. It is only created once the
+// request calls Grok.
+type requestDir struct {
+	id string
+	mu sync.Mutex
+	// calls are the Grok calls made so far, for the transcript, and pending
+	// counts those not over yet
+	calls   []*callTranscript
+	pending sync.WaitGroup
+}
+
+type requestDirContextKey struct{}
+
+func newRequestID() string {
+	return fmt.Sprintf("req_%d", time.Now().UnixNano())
+}
+
+// WithRequestID gives the request an ID, returned in the X-Request-Id header,
+// which names its directory. Once served and its Grok calls are over, the
+// request is added to the transcript archive under that ID. It goes inside
+// NeedAuthorization, so that only authorized requests are archived.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir := &requestDir{id: newRequestID()}
+		w.Header().Set("X-Request-Id", dir.id)
+		record, err := startTranscript(dir.id, w, r)
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			errMsg := fmt.Sprintf("Failed to read request body: %v", err)
+			writeErrorFor(w, r, newAPIError(errMsg, status))
+			log.Println(errMsg)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestDirContextKey{}, dir))
+		if record == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		record.served(recorder)
+		go record.archive(dir)
+	})
+}
+
+// requestDirOf returns the directory of the request ctx belongs to, or a new
+// one when the request went without WithRequestID.
+func requestDirOf(ctx context.Context) *requestDir {
+	if dir, ok := ctx.Value(requestDirContextKey{}).(*requestDir); ok {
+		return dir
+	}
+	return &requestDir{id: newRequestID()}
+}
+
+func requestPath(id string) string {
+	return filepath.Join(dataDir, "requests", id)
+}
+
+// grokCall is where the files of one Grok call of a request go. A request
+// makes several calls for n > 1 or JSON mode retries.
+type grokCall struct {
+	prompt  string
+	capture string
+	uploads string
+	record  *callTranscript
+}
+
+// nextCall creates the directory on the first call and returns the paths for
+// the call.
+func (d *requestDir) nextCall() (grokCall, error) {
+	d.pending.Add(1)
+	record := &callTranscript{Started: time.Now(), done: d.pending.Done}
+	d.mu.Lock()
+	d.calls = append(d.calls, record)
+	n := len(d.calls)
+	d.mu.Unlock()
+	if n == 1 {
+		if err := os.MkdirAll(requestPath(d.id), 0755); err != nil {
+			record.end()
+			return grokCall{}, err
+		}
+		pruneRequestDirs(d.id)
+	}
+	capture := filepath.Join(requestPath(d.id), fmt.Sprintf("response-%d.txt", n))
+	record.mu.Lock()
+	record.capture = capture
+	record.mu.Unlock()
+	return grokCall{
+		prompt:  filepath.Join(requestPath(d.id), fmt.Sprintf("prompt-%d.txt", n)),
+		capture: capture,
+		uploads: filepath.Join(requestPath(d.id), fmt.Sprintf("uploads-%d", n)),
+		record:  record,
+	}, nil
+}
+
+type requestDirInfo struct {
+	ID       string     `json:"id"`
+	Modified time.Time  `json:"modified"`
+	Files    []fileInfo `json:"files,omitempty"`
+}
+
+type fileInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// listRequestDirs returns the request directories, newest first.
+func listRequestDirs() []requestDirInfo {
+	entries, err := os.ReadDir(filepath.Join(dataDir, "requests"))
+	if err != nil {
+		return []requestDirInfo{}
+	}
+	dirs := []requestDirInfo{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		dirs = append(dirs, requestDirInfo{ID: entry.Name(), Modified: info.ModTime()})
+	}
+	slices.SortFunc(dirs, func(a, b requestDirInfo) int {
+		return b.Modified.Compare(a.Modified)
+	})
+	return dirs
+}
+
+// pruneRequestDirs removes the directories past the retention policy, except
+// the one of the request named keep.
+func pruneRequestDirs(keep string) {
+	pruneMu.Lock()
+	defer pruneMu.Unlock()
+	kept, limit := 0, maxRequests
+	if keep != "" {
+		limit--
+	}
+	for _, dir := range listRequestDirs() {
+		if dir.ID == keep {
+			continue
+		}
+		if kept < limit && time.Since(dir.Modified) <= requestTTL {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(requestPath(dir.ID)); err != nil {
+			log.Printf("Failed to remove request directory %s: %v", dir.ID, err)
+		}
+	}
+}
+
+// readRequestDir lists the files in the directory of the request with the
+// given ID.
+func readRequestDir(id string) (requestDirInfo, bool) {
+	if !validName(id) {
+		return requestDirInfo{}, false
+	}
+	path := requestPath(id)
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return requestDirInfo{}, false
+	}
+	dir := requestDirInfo{ID: id, Modified: info.ModTime(), Files: []fileInfo{}}
+	entries, _ := os.ReadDir(path)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			dir.Files = append(dir.Files, fileInfo{Name: entry.Name(), Size: info.Size()})
+		}
+	}
+	return dir, true
+}
+
+// validName keeps the names given to the admin endpoint inside the data dir.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && name != "." && name != ".."
+}
+
+// ScratchHandler shows the files of the requests. Without parameters it lists
+// the request directories, with id the files of one request, and with id and
+// file the content of a file, e.g. the prompt or raw response of a call.
+func ScratchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	file := r.URL.Query().Get("file")
+	if id == "" {
+		writeJSON(w, map[string]any{"requests": listRequestDirs()})
+		return
+	}
+	dir, ok := readRequestDir(id)
+	if !ok {
+		writeError(w, fmt.Sprintf("No files for request %s", id), http.StatusNotFound)
+		return
+	}
+	if file == "" {
+		writeJSON(w, dir)
+		return
+	}
+	if !validName(file) {
+		writeError(w, fmt.Sprintf("Invalid file name: %s", file), http.StatusBadRequest)
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(requestPath(dir.ID), file))
+	if err != nil {
+		writeError(w, fmt.Sprintf("No file %s for request %s", file, id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type AnthropicContentBlock struct {
+	Type     string                `json:"type"`
+	Text     string                `json:"text,omitempty"`
+	Thinking string                `json:"thinking,omitempty"`
+	Source   *anthropicImageSource `json:"source,omitempty"`
+}
+
+// MarshalJSON always writes the field matching the block type, even when empty,
+// since clients expect it to be present.
+func (b AnthropicContentBlock) MarshalJSON() ([]byte, error) {
+	switch b.Type {
+	case "text":
+		return json.Marshal(map[string]string{"type": b.Type, "text": b.Text})
+	case "thinking":
+		return json.Marshal(map[string]string{"type": b.Type, "thinking": b.Thinking, "signature": ""})
+	}
+	type plain AnthropicContentBlock
+	return json.Marshal(plain(b))
+}
+
+// AnthropicContent is either a plain string or a list of content blocks.
+type AnthropicContent []AnthropicContentBlock
+
+func (c *AnthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// Text joins the text blocks, ignoring anything Grok cannot take as a prompt.
+func (c AnthropicContent) Text() string {
+	var parts []string
+	for _, block := range c {
+		if block.Type == "text" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	System        AnthropicContent   `json:"system,omitempty"`
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Temperature   float64            `json:"temperature,omitempty"`
+	TopP          float64            `json:"top_p,omitempty"`
+	TopK          int                `json:"top_k,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Thinking      *anthropicThinking `json:"thinking,omitempty"`
+	// ReasoningMode overrides the server's reasoning mode: inline, separate or none.
+	ReasoningMode string `json:"reasoning_mode,omitempty"`
+	// Grok overrides the model's Grok options for this request.
+	Grok *GrokOptions `json:"grok,omitempty"`
+}
+
+// ThinkingEnabled reports whether the client asked for thinking blocks.
+func (r *AnthropicRequest) ThinkingEnabled() bool {
+	return r.Thinking != nil && r.Thinking.Type == "enabled"
+}
+
+// Content converts the blocks Grok can take into message content.
+func (c AnthropicContent) Content() MessageContent {
+	var content MessageContent
+	for _, block := range c {
+		switch block.Type {
+		case "text":
+			content = append(content, ContentPart{Type: "text", Text: block.Text})
+		case "image":
+			if block.Source == nil {
+				continue
+			}
+			imageURL := block.Source.URL
+			if block.Source.Type == "base64" {
+				imageURL = DataURL(block.Source.MediaType, block.Source.Data)
+			}
+			content = append(content, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: imageURL}})
+		}
+	}
+	return content
+}
+
+// ToMessages converts the request into the messages used to build the prompt.
+func (r *AnthropicRequest) ToMessages() []Message {
+	var msgs []Message
+	if system := r.System.Text(); system != "" {
+		msgs = append(msgs, Message{Role: "system", Content: TextContent(system)})
+	}
+	for _, msg := range r.Messages {
+		msgs = append(msgs, Message{Role: msg.Role, Content: msg.Content.Content()})
+	}
+	return msgs
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+type anthropicDelta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	Thinking     string  `json:"thinking,omitempty"`
+	StopReason   *string `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+type anthropicErrorBody struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// AnthropicStreamEvent is one server-sent event of a streamed message. An
+// error response has the same shape as the error event.
+type AnthropicStreamEvent struct {
+	Type         string                 `json:"type"`
+	Message      *AnthropicResponse     `json:"message,omitempty"`
+	Index        *int                   `json:"index,omitempty"`
+	ContentBlock *AnthropicContentBlock `json:"content_block,omitempty"`
+	Delta        *anthropicDelta        `json:"delta,omitempty"`
+	Usage        *AnthropicUsage        `json:"usage,omitempty"`
+	Error        *anthropicErrorBody    `json:"error,omitempty"`
+}
+
+// AnthropicStopReason maps an OpenAI finish reason to an Anthropic stop reason.
+// "stop_sequence" stands for an answer cut at one of the request's
+// stop_sequences.
+func AnthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "stop_sequence":
+		return "stop_sequence"
+	}
+	return "end_turn"
+}
+
+func BuildAnthropicResponse(content string, thinking string, id string, model string, finishReason string, stopSequence string, usage AnthropicUsage) *AnthropicResponse {
+	var blocks []AnthropicContentBlock
+	if thinking != "" {
+		blocks = append(blocks, AnthropicContentBlock{Type: "thinking", Thinking: thinking})
+	}
+	blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: content})
+	stopReason := AnthropicStopReason(finishReason)
+	response := &AnthropicResponse{
+		ID:         id,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    blocks,
+		StopReason: &stopReason,
+		Usage:      usage,
+	}
+	if stopSequence != "" {
+		response.StopSequence = &stopSequence
+	}
+	return response
+}
+
+func BuildAnthropicMessageStart(id string, model string, inputTokens int) *AnthropicStreamEvent {
+	return &AnthropicStreamEvent{
+		Type: "message_start",
+		Message: &AnthropicResponse{
+			ID:      id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   model,
+			Content: []AnthropicContentBlock{},
+			Usage:   AnthropicUsage{InputTokens: inputTokens},
+		},
+	}
+}
+
+func BuildAnthropicBlockStart(index int, blockType string) *AnthropicStreamEvent {
+	block := AnthropicContentBlock{Type: blockType}
+	return &AnthropicStreamEvent{Type: "content_block_start", Index: &index, ContentBlock: &block}
+}
+
+func BuildAnthropicBlockDelta(index int, blockType string, delta string) *AnthropicStreamEvent {
+	d := anthropicDelta{}
+	if blockType == "thinking" {
+		d.Type = "thinking_delta"
+		d.Thinking = delta
+	} else {
+		d.Type = "text_delta"
+		d.Text = delta
+	}
+	return &AnthropicStreamEvent{Type: "content_block_delta", Index: &index, Delta: &d}
+}
+
+func BuildAnthropicBlockStop(index int) *AnthropicStreamEvent {
+	return &AnthropicStreamEvent{Type: "content_block_stop", Index: &index}
+}
+
+func BuildAnthropicMessageDelta(finishReason string, stopSequence string, outputTokens int) *AnthropicStreamEvent {
+	stopReason := AnthropicStopReason(finishReason)
+	delta := &anthropicDelta{StopReason: &stopReason}
+	if stopSequence != "" {
+		delta.StopSequence = &stopSequence
+	}
+	return &AnthropicStreamEvent{
+		Type:  "message_delta",
+		Delta: delta,
+		Usage: &AnthropicUsage{OutputTokens: outputTokens},
+	}
+}
+
+func BuildAnthropicMessageStop() *AnthropicStreamEvent {
+	return &AnthropicStreamEvent{Type: "message_stop"}
+}
+
+func BuildAnthropicError(errType string, message string) *AnthropicStreamEvent {
+	return &AnthropicStreamEvent{Type: "error", Error: &anthropicErrorBody{Type: errType, Message: message}}
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// StopSequences accepts either a single string or a list of strings.
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var stop string
+	if err := json.Unmarshal(data, &stop); err == nil {
+		if stop == "" {
+			*s = nil
+		} else {
+			*s = StopSequences{stop}
+		}
+		return nil
+	}
+	var stops []string
+	if err := json.Unmarshal(data, &stops); err != nil {
+		return err
+	}
+	*s = stops
+	return nil
+}
+
+// CompletionPrompt accepts either a string or a list holding a single string,
+// since Grok answers one prompt at a time.
+type CompletionPrompt string
+
+func (p *CompletionPrompt) UnmarshalJSON(data []byte) error {
+	var prompt string
+	if err := json.Unmarshal(data, &prompt); err == nil {
+		*p = CompletionPrompt(prompt)
+		return nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(data, &prompts); err != nil {
+		return err
+	}
+	if len(prompts) != 1 {
+		return errors.New("only a single prompt is supported")
+	}
+	*p = CompletionPrompt(prompts[0])
+	return nil
+}
+
+type OpenAICompletionRequest struct {
+	Model         string           `json:"model"`
+	Prompt        CompletionPrompt `json:"prompt"`
+	Stop          StopSequences    `json:"stop,omitempty"`
+	Echo          bool             `json:"echo,omitempty"`
+	Temperature   float64          `json:"temperature,omitempty"`
+	TopP          float64          `json:"top_p,omitempty"`
+	MaxTokens     int              `json:"max_tokens,omitempty"`
+	Stream        bool             `json:"stream,omitempty"`
+	StreamOptions *StreamOptions   `json:"stream_options,omitempty"`
+	// ReasoningMode overrides the server's reasoning mode. There is no field for
+	// reasoning in this API, so separate drops it like none.
+	ReasoningMode string `json:"reasoning_mode,omitempty"`
+	// Grok overrides the model's Grok options for this request.
+	Grok *GrokOptions `json:"grok,omitempty"`
+}
+
+type openAICompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type OpenAICompletionResponse struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []openAICompletionChoice `json:"choices"`
+	Usage   *OpenAIUsage             `json:"usage,omitempty"`
+}
+
+func BuildCompletionChunk(text string, requestID string, model string) *OpenAICompletionResponse {
+	choices := []openAICompletionChoice{
+		{
+			Text:  text,
+			Index: 0,
+		},
+	}
+	return &OpenAICompletionResponse{
+		ID:      requestID,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: choices,
+	}
+}
+
+func BuildCompletionFinish(requestID string, model string, finishReason string) *OpenAICompletionResponse {
+	chunk := BuildCompletionChunk("", requestID, model)
+	chunk.Choices[0].FinishReason = &finishReason
+	return chunk
+}
+
+func BuildCompletionResponse(text string, requestID string, model string, finishReason string, usage OpenAIUsage) *OpenAICompletionResponse {
+	response := BuildCompletionFinish(requestID, model, finishReason)
+	response.Choices[0].Text = text
+	response.Usage = &usage
+	return response
+}
+
+// BuildCompletionUsage builds the last chunk of a stream that asked for usage.
+func BuildCompletionUsage(requestID string, model string, usage OpenAIUsage) *OpenAICompletionResponse {
+	return &OpenAICompletionResponse{
+		ID:      requestID,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openAICompletionChoice{},
+		Usage:   &usage,
+	}
+}
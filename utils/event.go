@@ -0,0 +1,76 @@
+package utils
+
+// EventType tells what kind of data an Event carries.
+type EventType int
+
+const (
+	// EventText is a piece of the final answer.
+	EventText EventType = iota
+	// EventReasoning is a piece of Grok's thinking.
+	EventReasoning
+	// EventResearch is a piece of a DeepSearch research step.
+	EventResearch
+	// EventMetadata carries the ids Grok assigns to the conversation and response.
+	EventMetadata
+	// EventError means the generation failed; no more events follow.
+	EventError
+	// EventFinish means the generation ended normally.
+	EventFinish
+)
+
+// Event is one item of the stream produced by the client package for a request.
+// The channel carrying events is closed once the session is done with the request.
+type Event struct {
+	Type           EventType
+	Text           string
+	Step           int
+	ResponseID     string
+	ConversationID string
+	FinishReason   string
+	Err            error
+	// Session is the session whose account owns the conversation
+	Session int
+}
+
+func TextEvent(text string) Event {
+	return Event{Type: EventText, Text: text}
+}
+
+func ReasoningEvent(text string) Event {
+	return Event{Type: EventReasoning, Text: text}
+}
+
+func ResearchEvent(step int, text string) Event {
+	return Event{Type: EventResearch, Step: step, Text: text}
+}
+
+func MetadataEvent(session int, conversationID string, responseID string) Event {
+	return Event{Type: EventMetadata, Session: session, ConversationID: conversationID, ResponseID: responseID}
+}
+
+func ErrorEvent(err error) Event {
+	return Event{Type: EventError, Err: err}
+}
+
+func FinishEvent(reason string) Event {
+	return Event{Type: EventFinish, FinishReason: reason}
+}
+
+// Conversation is a chat on Grok, which only the session whose account owns
+// it can continue.
+type Conversation struct {
+	Session        int
+	ConversationID string
+	ResponseID     string
+}
+
+// Update takes the ids carried by a metadata event.
+func (c *Conversation) Update(event Event) {
+	c.Session = event.Session
+	if event.ConversationID != "" {
+		c.ConversationID = event.ConversationID
+	}
+	if event.ResponseID != "" {
+		c.ResponseID = event.ResponseID
+	}
+}
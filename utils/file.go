@@ -16,6 +16,16 @@ func MakeDirIfNotExist(dir string) error {
 	return nil
 }
 
+// WriteFileAtomic replaces the file at path with data, so that a crash never
+// leaves it half written.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func ReadCookies() ([]string, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
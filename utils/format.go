@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type jsonSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+// ResponseFormat is the response_format field: text, json_object or json_schema.
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *jsonSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// IsJSON reports whether the answer must be JSON.
+func (f *ResponseFormat) IsJSON() bool {
+	return f != nil && (f.Type == "json_object" || f.Type == "json_schema")
+}
+
+func (f *ResponseFormat) Validate() error {
+	if f == nil {
+		return nil
+	}
+	switch f.Type {
+	case "", "text", "json_object":
+		return nil
+	case "json_schema":
+		if f.JSONSchema == nil || len(f.JSONSchema.Schema) == 0 {
+			return errors.New("response_format json_schema requires a schema")
+		}
+		var schema any
+		if err := json.Unmarshal(f.JSONSchema.Schema, &schema); err != nil {
+			return fmt.Errorf("invalid json_schema: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported response_format type: %s", f.Type)
+}
+
+// FormatResponseFormat returns the output constraints as a system message
+// to place after the conversation.
+func FormatResponseFormat(f *ResponseFormat) []Message {
+	if !f.IsJSON() {
+		return nil
+	}
+	var b strings.Builder
+	if f.Type == "json_schema" {
+		b.WriteString("Reply with a single JSON value that matches the following JSON schema")
+		if f.JSONSchema.Name != "" {
+			fmt.Fprintf(&b, " (named %s)", f.JSONSchema.Name)
+		}
+		b.WriteString(":\n")
+		if f.JSONSchema.Description != "" {
+			b.WriteString(f.JSONSchema.Description + "\n")
+		}
+		b.WriteString(compactJSON(f.JSONSchema.Schema) + "\n")
+	} else {
+		b.WriteString("Reply with a single JSON object.\n")
+	}
+	b.WriteString("Write only the JSON, with no explanation and no code fence.")
+	return SystemMessages(b.String())
+}
+
+// FormatJSONRetry returns the messages added to the conversation after an
+// answer that failed validation, so that Grok can correct it.
+func FormatJSONRetry(answer string, err error) []Message {
+	return []Message{
+		{Role: "assistant", Content: TextContent(answer)},
+		{Role: "system", Content: TextContent(fmt.Sprintf("That reply was rejected: %v. Reply again with only the corrected JSON.", err))},
+	}
+}
+
+// ValidateJSONAnswer extracts the JSON from Grok's answer and checks it
+// against the format. It returns the JSON text on success.
+func ValidateJSONAnswer(answer string, f *ResponseFormat) (string, error) {
+	text, err := ExtractJSON(answer)
+	if err != nil {
+		return "", err
+	}
+	var value any
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return "", err
+	}
+	if f.Type == "json_object" {
+		if _, ok := value.(map[string]any); !ok {
+			return "", fmt.Errorf("expected a JSON object, got %s", typeName(value))
+		}
+		return text, nil
+	}
+	if err := ValidateJSONSchema(value, f.JSONSchema.Schema); err != nil {
+		return "", err
+	}
+	return text, nil
+}
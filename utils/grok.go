@@ -0,0 +1,87 @@
+package utils
+
+import "fmt"
+
+// Attachment behaviors decide when the prompt is uploaded as a file instead
+// of being typed in.
+const (
+	// AttachAuto uploads prompts that are too long to type in
+	AttachAuto   = "auto"
+	AttachAlways = "always"
+	AttachNever  = "never"
+)
+
+func validAttachments(attachments string) bool {
+	switch attachments {
+	case "", AttachAuto, AttachAlways, AttachNever:
+		return true
+	}
+	return false
+}
+
+// GrokOptions is the grok extension object of a request body. The fields
+// that are set override the model's defaults for the call.
+type GrokOptions struct {
+	Private            *bool   `json:"private,omitempty"`
+	Think              *bool   `json:"think,omitempty"`
+	DeepSearch         *bool   `json:"deepsearch,omitempty"`
+	DeeperSearch       *bool   `json:"deepersearch,omitempty"`
+	CustomInstructions *string `json:"custom_instructions,omitempty"`
+	Attachments        string  `json:"attachments,omitempty"`
+}
+
+// Overrides returns the JSON names of the options that are set.
+func (o *GrokOptions) Overrides() []string {
+	if o == nil {
+		return nil
+	}
+	var names []string
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{"private", o.Private != nil},
+		{"think", o.Think != nil},
+		{"deepsearch", o.DeepSearch != nil},
+		{"deepersearch", o.DeeperSearch != nil},
+		{"custom_instructions", o.CustomInstructions != nil},
+		{"attachments", o.Attachments != ""},
+	} {
+		if option.set {
+			names = append(names, option.name)
+		}
+	}
+	return names
+}
+
+// Apply returns the model with the options set. Turning on a search mode
+// also switches to the parser it needs.
+func (o *GrokOptions) Apply(model Model) (Model, error) {
+	if o == nil {
+		return model, nil
+	}
+	if !validAttachments(o.Attachments) {
+		return model, fmt.Errorf("grok.attachments must be auto, always or never, got %q", o.Attachments)
+	}
+	set := func(field *bool, value *bool) {
+		if value != nil {
+			*field = *value
+		}
+	}
+	set(&model.Private, o.Private)
+	set(&model.Think, o.Think)
+	set(&model.DeepSearch, o.DeepSearch)
+	set(&model.DeeperSearch, o.DeeperSearch)
+	if o.CustomInstructions != nil {
+		model.CustomInstructions = *o.CustomInstructions
+	}
+	if o.Attachments != "" {
+		model.Attachments = o.Attachments
+	}
+	if model.DeepSearch || model.DeeperSearch {
+		model.Parser = ParserDeepSearch
+	} else if o.DeepSearch != nil || o.DeeperSearch != nil {
+		model.Parser = ParserChat
+	}
+	return model, nil
+}
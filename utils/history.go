@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// NumberImages returns the messages with each image replaced by the marker
+// it gets in the prompt, so that parts of the conversation written on their
+// own still refer to the images by their place in the whole.
+func NumberImages(msgs []Message) []Message {
+	numbered := make([]Message, len(msgs))
+	images := 0
+	for i, msg := range msgs {
+		numbered[i] = msg
+		switch msg.Role {
+		case "user", "assistant", "system", "developer":
+		default:
+			continue
+		}
+		content := make(MessageContent, len(msg.Content))
+		for j, part := range msg.Content {
+			if part.Type == "image_url" {
+				images++
+				part = ContentPart{Type: "text", Text: fmt.Sprintf("[image %d]", images)}
+			}
+			content[j] = part
+		}
+		numbered[i].Content = content
+	}
+	return numbered
+}
+
+// SplitHistory divides msgs at the last user message into the system messages
+// before it, the rest of what came before it, and the latest turn from it on.
+func SplitHistory(msgs []Message) (system []Message, history []Message, latest []Message) {
+	last := len(msgs) - 1
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == "user" {
+			last = i
+			break
+		}
+	}
+	if last < 0 {
+		return nil, nil, nil
+	}
+	for _, msg := range msgs[:last] {
+		if msg.Role == "system" || msg.Role == "developer" {
+			system = append(system, msg)
+		} else {
+			history = append(history, msg)
+		}
+	}
+	return system, history, msgs[last:]
+}
+
+// SplitText cuts text into pieces of at most size bytes, preferring to cut
+// after a blank line, then after a line.
+func SplitText(text string, size int) []string {
+	var pieces []string
+	for len(text) > size {
+		cut := strings.LastIndex(text[:size], "\n\n") + 2
+		if cut < size/2 {
+			cut = strings.LastIndex(text[:size], "\n") + 1
+		}
+		if cut < size/2 {
+			cut = size
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+		}
+		pieces = append(pieces, text[:cut])
+		text = text[cut:]
+	}
+	if text != "" {
+		pieces = append(pieces, text)
+	}
+	return pieces
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		size int
+		want []string
+	}{
+		{"short", "hello", 10, []string{"hello"}},
+		{"empty", "", 10, nil},
+		{"after a blank line", "aaaa\n\nbbbb\ncc", 10, []string{"aaaa\n\n", "bbbb\ncc"}},
+		{"after a line", "aaaaaa\nbbbbbbb", 10, []string{"aaaaaa\n", "bbbbbbb"}},
+		{"blank line too early", "a\n\nbbbbbbbbbbbb", 10, []string{"a\n\nbbbbbbb", "bbbbb"}},
+		{"no line breaks", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"not inside a character", "abcdé", 5, []string{"abcd", "é"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitText(tt.text, tt.size)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitTextKeepsEverything(t *testing.T) {
+	text := strings.Repeat("Some line of text, with ünïcödé 漢字.\n", 200) + strings.Repeat("x", 3000)
+	pieces := SplitText(text, 1000)
+	if strings.Join(pieces, "") != text {
+		t.Fatal("the pieces do not add up to the text")
+	}
+	for i, piece := range pieces {
+		if len(piece) > 1000 || !utf8.ValidString(piece) {
+			t.Errorf("piece %d is %d bytes, valid %v", i, len(piece), utf8.ValidString(piece))
+		}
+	}
+}
+
+func TestSplitHistory(t *testing.T) {
+	msg := func(role, text string) Message {
+		return Message{Role: role, Content: TextContent(text)}
+	}
+	texts := func(msgs []Message) []string {
+		var out []string
+		for _, m := range msgs {
+			out = append(out, m.Content.Text())
+		}
+		return out
+	}
+	tests := []struct {
+		name                    string
+		msgs                    []Message
+		system, history, latest []string
+	}{
+		{"empty", nil, nil, nil, nil},
+		{"one user message", []Message{msg("user", "u1")}, nil, nil, []string{"u1"}},
+		{
+			name:    "conversation",
+			msgs:    []Message{msg("system", "s"), msg("user", "u1"), msg("assistant", "a1"), msg("developer", "d"), msg("user", "u2"), msg("assistant", "a2")},
+			system:  []string{"s", "d"},
+			history: []string{"u1", "a1"},
+			latest:  []string{"u2", "a2"},
+		},
+		{
+			name:   "no user message",
+			msgs:   []Message{msg("system", "s"), msg("assistant", "a")},
+			system: []string{"s"},
+			latest: []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			system, history, latest := SplitHistory(tt.msgs)
+			if !slices.Equal(texts(system), tt.system) || !slices.Equal(texts(history), tt.history) || !slices.Equal(texts(latest), tt.latest) {
+				t.Errorf("got %q, %q, %q; want %q, %q, %q", texts(system), texts(history), texts(latest), tt.system, tt.history, tt.latest)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// SaveImage turns an image url into a file that can be uploaded to Grok.
+// Data urls are decoded into dir/name plus an extension. Local files (a
+// file:// url or a plain path) are used in place, but only when they are
+// inside localDir; an empty localDir disables local files.
+func SaveImage(imageURL string, dir string, name string, localDir string) (string, error) {
+	if strings.HasPrefix(imageURL, "data:") {
+		return saveDataURL(imageURL, dir, name)
+	}
+	if strings.HasPrefix(imageURL, "http://") || strings.HasPrefix(imageURL, "https://") {
+		return "", errors.New("remote image urls are not supported, send the image as a data url")
+	}
+	if localDir == "" {
+		return "", errors.New("local images are disabled")
+	}
+	path := imageURL
+	if strings.HasPrefix(imageURL, "file://") {
+		parsed, err := url.Parse(imageURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid file url: %v", err)
+		}
+		path = parsed.Path
+	}
+	return resolveLocalImage(path, localDir)
+}
+
+func saveDataURL(dataURL string, dir string, name string) (string, error) {
+	header, data, found := strings.Cut(strings.TrimPrefix(dataURL, "data:"), ",")
+	if !found || !strings.HasSuffix(header, ";base64") {
+		return "", errors.New("image data url must be base64 encoded")
+	}
+	mediaType := strings.TrimSuffix(header, ";base64")
+	ext, ok := imageExtensions[mediaType]
+	if !ok {
+		return "", fmt.Errorf("unsupported image type: %s", mediaType)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %v", err)
+	}
+	if err := MakeDirIfNotExist(dir); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name+ext)
+	if err := os.WriteFile(path, decoded, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func resolveLocalImage(path string, localDir string) (string, error) {
+	root, err := filepath.Abs(localDir)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	// resolve links first so they cannot point out of the directory
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("image %s is outside the local image directory", path)
+	}
+	if _, ok := imageExtensions[mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))]; !ok {
+		return "", fmt.Errorf("unsupported image type: %s", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("image %s is a directory", path)
+	}
+	return path, nil
+}
+
+// DataURL encodes raw image bytes as a data url, guessing the media type
+// from the content when it is not given.
+func DataURL(mediaType string, data string) string {
+	if mediaType == "" {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err == nil {
+			mediaType = http.DetectContentType(decoded)
+		}
+	}
+	return "data:" + mediaType + ";base64," + data
+}
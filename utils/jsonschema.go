@@ -0,0 +1,330 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidateJSONSchema checks a decoded JSON value against a JSON schema. It
+// covers the keywords commonly used for structured outputs: type, enum,
+// const, properties, required, additionalProperties, items, the numeric,
+// string and array bounds, pattern, allOf/anyOf/oneOf/not and local $ref.
+func ValidateJSONSchema(value any, schema json.RawMessage) error {
+	var root any
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	v := schemaValidator{root: root}
+	return v.validate(value, root, "$", 0)
+}
+
+type schemaValidator struct {
+	root any
+}
+
+// maxSchemaDepth guards against recursive $ref loops.
+const maxSchemaDepth = 64
+
+func (v *schemaValidator) validate(value any, schema any, path string, depth int) error {
+	if depth > maxSchemaDepth {
+		return fmt.Errorf("%s: schema is nested too deeply", path)
+	}
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			return fmt.Errorf("%s: no value is allowed here", path)
+		}
+		return nil
+	case map[string]any:
+		return v.validateObject(value, s, path, depth)
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateObject(value any, s map[string]any, path string, depth int) error {
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := v.resolve(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := v.validate(value, target, path, depth+1); err != nil {
+			return err
+		}
+	}
+	if t, ok := s["type"]; ok {
+		if err := checkType(value, t, path); err != nil {
+			return err
+		}
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed values", path)
+		}
+	}
+	if constant, ok := s["const"]; ok && !reflect.DeepEqual(value, constant) {
+		return fmt.Errorf("%s: value must be %v", path, constant)
+	}
+	switch val := value.(type) {
+	case map[string]any:
+		if err := v.validateProperties(val, s, path, depth); err != nil {
+			return err
+		}
+	case []any:
+		if err := v.validateItems(val, s, path, depth); err != nil {
+			return err
+		}
+	case string:
+		length := utf8.RuneCountInString(val)
+		if n, ok := number(s["minLength"]); ok && float64(length) < n {
+			return fmt.Errorf("%s: string is shorter than %v", path, n)
+		}
+		if n, ok := number(s["maxLength"]); ok && float64(length) > n {
+			return fmt.Errorf("%s: string is longer than %v", path, n)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(val) {
+				return fmt.Errorf("%s: string does not match %s", path, pattern)
+			}
+		}
+	case float64:
+		if n, ok := number(s["minimum"]); ok && val < n {
+			return fmt.Errorf("%s: %v is less than %v", path, val, n)
+		}
+		if n, ok := number(s["maximum"]); ok && val > n {
+			return fmt.Errorf("%s: %v is greater than %v", path, val, n)
+		}
+		if n, ok := number(s["exclusiveMinimum"]); ok && val <= n {
+			return fmt.Errorf("%s: %v must be greater than %v", path, val, n)
+		}
+		if n, ok := number(s["exclusiveMaximum"]); ok && val >= n {
+			return fmt.Errorf("%s: %v must be less than %v", path, val, n)
+		}
+	}
+	if all, ok := s["allOf"].([]any); ok {
+		for _, sub := range all {
+			if err := v.validate(value, sub, path, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		if v.countMatches(value, anyOf, path, depth) == 0 {
+			return fmt.Errorf("%s: value does not match any of the allowed schemas", path)
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		if v.countMatches(value, oneOf, path, depth) != 1 {
+			return fmt.Errorf("%s: value must match exactly one of the allowed schemas", path)
+		}
+	}
+	if not, ok := s["not"]; ok {
+		if v.validate(value, not, path, depth+1) == nil {
+			return fmt.Errorf("%s: value matches a schema it must not match", path)
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateProperties(val map[string]any, s map[string]any, path string, depth int) error {
+	properties, _ := s["properties"].(map[string]any)
+	if required, ok := s["required"].([]any); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := val[key]; !present {
+					return fmt.Errorf("%s: missing required property %q", path, key)
+				}
+			}
+		}
+	}
+	keys := make([]string, 0, len(val))
+	for key := range val {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if sub, ok := properties[key]; ok {
+			if err := v.validate(val[key], sub, path+"."+key, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if additional, ok := s["additionalProperties"]; ok {
+			if allowed, isBool := additional.(bool); isBool && !allowed {
+				return fmt.Errorf("%s: property %q is not allowed", path, key)
+			}
+			if err := v.validate(val[key], additional, path+"."+key, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if n, ok := number(s["minProperties"]); ok && float64(len(val)) < n {
+		return fmt.Errorf("%s: object has fewer than %v properties", path, n)
+	}
+	if n, ok := number(s["maxProperties"]); ok && float64(len(val)) > n {
+		return fmt.Errorf("%s: object has more than %v properties", path, n)
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateItems(val []any, s map[string]any, path string, depth int) error {
+	if n, ok := number(s["minItems"]); ok && float64(len(val)) < n {
+		return fmt.Errorf("%s: array has fewer than %v items", path, n)
+	}
+	if n, ok := number(s["maxItems"]); ok && float64(len(val)) > n {
+		return fmt.Errorf("%s: array has more than %v items", path, n)
+	}
+	if items, ok := s["items"]; ok {
+		for i, item := range val {
+			if err := v.validate(item, items, fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if unique, ok := s["uniqueItems"].(bool); ok && unique {
+		for i := range val {
+			for j := i + 1; j < len(val); j++ {
+				if reflect.DeepEqual(val[i], val[j]) {
+					return fmt.Errorf("%s: items %d and %d are equal", path, i, j)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) countMatches(value any, schemas []any, path string, depth int) int {
+	matches := 0
+	for _, sub := range schemas {
+		if v.validate(value, sub, path, depth+1) == nil {
+			matches++
+		}
+	}
+	return matches
+}
+
+// resolve follows a JSON pointer into the root schema, such as #/$defs/Item.
+func (v *schemaValidator) resolve(ref string) (any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local references are supported: %s", ref)
+	}
+	node := v.root
+	pointer := strings.TrimPrefix(ref, "#")
+	if pointer == "" {
+		return node, nil
+	}
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference: %s", ref)
+		}
+		if node, ok = object[token]; !ok {
+			return nil, fmt.Errorf("unresolvable reference: %s", ref)
+		}
+	}
+	return node, nil
+}
+
+func checkType(value any, t any, path string) error {
+	var types []string
+	switch tt := t.(type) {
+	case string:
+		types = []string{tt}
+	case []any:
+		for _, name := range tt {
+			if s, ok := name.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	for _, name := range types {
+		if hasType(value, name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), typeName(value))
+}
+
+func hasType(value any, name string) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+func typeName(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return "unknown"
+}
+
+func number(value any) (float64, bool) {
+	n, ok := value.(float64)
+	return n, ok
+}
+
+// ExtractJSON finds the JSON value in an answer, skipping code fences and any
+// text around the value.
+func ExtractJSON(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if json.Valid([]byte(text)) {
+		return text, nil
+	}
+	for i, r := range text {
+		if r != '{' && r != '[' {
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(text[i:]))
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == nil {
+			return string(raw), nil
+		}
+	}
+	return "", errors.New("the answer does not contain a JSON value")
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+	person := `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2, "uniqueItems": true},
+			"role": {"enum": ["admin", "user"]}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	}`
+	tests := []struct {
+		name    string
+		schema  string
+		value   string
+		wantErr string
+	}{
+		{"valid object", person, `{"name": "Ann", "age": 3, "tags": ["a"], "role": "user"}`, ""},
+		{"missing required", person, `{"age": 3}`, "name"},
+		{"wrong type", person, `{"name": 3}`, "$.name"},
+		{"not an integer", person, `{"name": "Ann", "age": 1.5}`, "$.age"},
+		{"below minimum", person, `{"name": "Ann", "age": -1}`, "$.age"},
+		{"additional property", person, `{"name": "Ann", "extra": true}`, "extra"},
+		{"too many items", person, `{"name": "Ann", "tags": ["a", "b", "c"]}`, "$.tags"},
+		{"duplicate items", person, `{"name": "Ann", "tags": ["a", "a"]}`, "$.tags"},
+		{"not in enum", person, `{"name": "Ann", "role": "root"}`, "$.role"},
+		{"empty string", person, `{"name": ""}`, "$.name"},
+		{"type list", `{"type": ["string", "null"]}`, `null`, ""},
+		{"const", `{"const": 3}`, `4`, "$"},
+		{"pattern", `{"type": "string", "pattern": "^[a-z]+$"}`, `"abc1"`, "$"},
+		{"anyOf", `{"anyOf": [{"type": "string"}, {"type": "number"}]}`, `true`, "$"},
+		{"oneOf matching both", `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `1`, "$"},
+		{"not", `{"not": {"type": "string"}}`, `"a"`, "$"},
+		{"false schema", `{"properties": {"a": false}}`, `{"a": 1}`, "$.a"},
+		{"local ref", `{"$defs": {"n": {"type": "number"}}, "items": {"$ref": "#/$defs/n"}}`, `[1, "2"]`, "$[1]"},
+		{"recursive ref", `{"$ref": "#"}`, `1`, "nested too deeply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value any
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			err := ValidateJSONSchema(value, json.RawMessage(tt.schema))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("got error %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateJSONSchemaRejectsInvalidSchema(t *testing.T) {
+	if err := ValidateJSONSchema(nil, json.RawMessage(`{`)); err == nil {
+		t.Error("expected an error for an invalid schema")
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{"bare object", ` {"a": 1} `, `{"a": 1}`, false},
+		{"bare array", `[1, 2]`, `[1, 2]`, false},
+		{"code fence", "```json\n{\"a\": 1}\n```", `{"a": 1}`, false},
+		{"text around", `Here you go: {"a": {"b": [1]}} Hope that helps.`, `{"a": {"b": [1]}}`, false},
+		{"stray brace before", `Use {braces} like {"a": 1}`, `{"a": 1}`, false},
+		{"no json", `Sorry, I cannot do that.`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractJSON(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateJSONAnswer(t *testing.T) {
+	object := &ResponseFormat{Type: "json_object"}
+	if _, err := ValidateJSONAnswer(`[1]`, object); err == nil {
+		t.Error("an array is not a JSON object")
+	}
+	if got, err := ValidateJSONAnswer("```\n{\"a\": 1}\n```", object); err != nil || got != `{"a": 1}` {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// APIKey is an accepted API key and which grok options its requests may set.
+type APIKey struct {
+	Key string `json:"key"`
+	// Allow holds the names of the grok options, or "*" for all of them
+	Allow []string `json:"allow,omitempty"`
+	// Template overrides the prompt template of the models when set
+	Template string `json:"template,omitempty"`
+}
+
+// Allows reports whether requests with the key may set the named option.
+func (k APIKey) Allows(option string) bool {
+	return slices.Contains(k.Allow, "*") || slices.Contains(k.Allow, option)
+}
+
+// LoadAPIKeys reads a JSON array of API keys from path.
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	for i, key := range keys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("API key %d is empty", i+1)
+		}
+		if key.Template != "" {
+			if _, err := LoadPromptTemplate(key.Template); err != nil {
+				return nil, fmt.Errorf("API key %d: %v", i+1, err)
+			}
+		}
+	}
+	return keys, nil
+}
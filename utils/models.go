@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Parsers read Grok's response stream. Search models stream their progress
+// in a different shape from plain chat.
+const (
+	ParserChat       = "chat"
+	ParserDeepSearch = "deepsearch"
+)
+
+// Model is a model ID served by the proxy and how it is set up in Grok's UI.
+type Model struct {
+	ID string `json:"id"`
+	// Think, DeepSearch, DeeperSearch and Private are the composer toggles
+	// turned on before sending
+	Think        bool `json:"think,omitempty"`
+	DeepSearch   bool `json:"deepsearch,omitempty"`
+	DeeperSearch bool `json:"deepersearch,omitempty"`
+	Private      bool `json:"private,omitempty"`
+	// CustomInstructions are sent as a system message before the prompt
+	CustomInstructions string `json:"custom_instructions,omitempty"`
+	// Attachments is one of the attachment behaviors, AttachAuto when empty
+	Attachments string `json:"attachments,omitempty"`
+	// Parser is ParserChat or ParserDeepSearch, ParserChat when empty
+	Parser string `json:"parser,omitempty"`
+	// ContextLimit is the most prompt tokens accepted, 0 for no limit
+	ContextLimit int `json:"context_limit,omitempty"`
+	// Aliases are other names the model is requested by, e.g. gpt-4o
+	Aliases []string `json:"aliases,omitempty"`
+	// Hidden leaves the model out of the model lists
+	Hidden bool `json:"hidden,omitempty"`
+	// Template is a preset name or a template file the prompt is written
+	// with, the server's default when empty
+	Template string `json:"template,omitempty"`
+}
+
+// DefaultModels are the models served when no models file is given.
+func DefaultModels() []Model {
+	return []Model{
+		{ID: "grok-3", Parser: ParserChat, ContextLimit: 131072},
+		{ID: "grok-3-think", Think: true, Parser: ParserChat, ContextLimit: 131072},
+		{ID: "grok-3-deepsearch", DeepSearch: true, Parser: ParserDeepSearch, ContextLimit: 131072},
+		{ID: "grok-3-deepersearch", DeeperSearch: true, Parser: ParserDeepSearch, ContextLimit: 131072},
+	}
+}
+
+// ModelRegistry finds models by ID or alias.
+type ModelRegistry struct {
+	models []Model
+	byName map[string]int
+}
+
+// NewModelRegistry checks the models and indexes them. Names are matched
+// without regard to case.
+func NewModelRegistry(models []Model) (*ModelRegistry, error) {
+	registry := &ModelRegistry{byName: make(map[string]int)}
+	for i, model := range models {
+		if model.ID == "" {
+			return nil, fmt.Errorf("model %d has no id", i+1)
+		}
+		switch model.Parser {
+		case "":
+			model.Parser = ParserChat
+		case ParserChat, ParserDeepSearch:
+		default:
+			return nil, fmt.Errorf("model %s: unknown parser %q", model.ID, model.Parser)
+		}
+		if !validAttachments(model.Attachments) {
+			return nil, fmt.Errorf("model %s: attachments must be auto, always or never", model.ID)
+		}
+		if model.ContextLimit < 0 {
+			return nil, fmt.Errorf("model %s: context_limit must not be negative", model.ID)
+		}
+		if model.Template != "" {
+			if _, err := LoadPromptTemplate(model.Template); err != nil {
+				return nil, fmt.Errorf("model %s: %v", model.ID, err)
+			}
+		}
+		for _, name := range append([]string{model.ID}, model.Aliases...) {
+			key := strings.ToLower(name)
+			if _, ok := registry.byName[key]; ok {
+				return nil, fmt.Errorf("model %s: name %s is already taken", model.ID, name)
+			}
+			registry.byName[key] = len(registry.models)
+		}
+		registry.models = append(registry.models, model)
+	}
+	if len(registry.models) == 0 {
+		return nil, fmt.Errorf("no models defined")
+	}
+	return registry, nil
+}
+
+// LoadModels reads a JSON array of models from path.
+func LoadModels(path string) (*ModelRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var models []Model
+	if err := json.Unmarshal(data, &models); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return NewModelRegistry(models)
+}
+
+// Lookup returns the model requested by name, which may be an alias.
+func (r *ModelRegistry) Lookup(name string) (Model, bool) {
+	i, ok := r.byName[strings.ToLower(name)]
+	if !ok {
+		return Model{}, false
+	}
+	return r.models[i], true
+}
+
+// Listed returns the IDs of the models that are not hidden.
+func (r *ModelRegistry) Listed() []string {
+	var ids []string
+	for _, model := range r.models {
+		if !model.Hidden {
+			ids = append(ids, model.ID)
+		}
+	}
+	return ids
+}
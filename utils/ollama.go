@@ -0,0 +1,163 @@
+package utils
+
+import "time"
+
+type OllamaMessage struct {
+	Role     string   `json:"role"`
+	Content  string   `json:"content"`
+	Thinking string   `json:"thinking,omitempty"`
+	Images   []string `json:"images,omitempty"`
+}
+
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	// Stream defaults to true in the Ollama API, hence the pointer.
+	Stream  *bool          `json:"stream,omitempty"`
+	Think   *bool          `json:"think,omitempty"`
+	Options *OllamaOptions `json:"options,omitempty"`
+	// ReasoningMode overrides the server's reasoning mode: inline, separate or none.
+	ReasoningMode string `json:"reasoning_mode,omitempty"`
+	// Grok overrides the model's Grok options for this request.
+	Grok *GrokOptions `json:"grok,omitempty"`
+}
+
+type OllamaGenerateRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	System  string         `json:"system,omitempty"`
+	Images  []string       `json:"images,omitempty"`
+	Raw     bool           `json:"raw,omitempty"`
+	Stream  *bool          `json:"stream,omitempty"`
+	Think   *bool          `json:"think,omitempty"`
+	Options *OllamaOptions `json:"options,omitempty"`
+	// ReasoningMode overrides the server's reasoning mode: inline, separate or none.
+	ReasoningMode string `json:"reasoning_mode,omitempty"`
+	// Grok overrides the model's Grok options for this request.
+	Grok *GrokOptions `json:"grok,omitempty"`
+}
+
+// OllamaOptions are the model options of a request. Only the limits on the
+// answer are read, Grok has no equivalent of the sampling options.
+type OllamaOptions struct {
+	Stop StopSequences `json:"stop,omitempty"`
+	// NumPredict is the most tokens to generate, no limit when not positive.
+	NumPredict int `json:"num_predict,omitempty"`
+}
+
+// OllamaStreaming reports whether a request with the given stream field
+// should stream, which is the default in the Ollama API.
+func OllamaStreaming(stream *bool) bool {
+	return stream == nil || *stream
+}
+
+// ollamaContent builds message content from text and base64 encoded images.
+func ollamaContent(text string, images []string) MessageContent {
+	content := TextContent(text)
+	for _, image := range images {
+		content = append(content, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: DataURL("", image)}})
+	}
+	return content
+}
+
+func (r *OllamaChatRequest) ToMessages() []Message {
+	msgs := make([]Message, 0, len(r.Messages))
+	for _, msg := range r.Messages {
+		msgs = append(msgs, Message{Role: msg.Role, Content: ollamaContent(msg.Content, msg.Images)})
+	}
+	return msgs
+}
+
+func (r *OllamaGenerateRequest) ToMessages() []Message {
+	var msgs []Message
+	if r.System != "" {
+		msgs = append(msgs, Message{Role: "system", Content: TextContent(r.System)})
+	}
+	return append(msgs, Message{Role: "user", Content: ollamaContent(r.Prompt, r.Images)})
+}
+
+// OllamaResponse is a record of /api/chat (Message set) or /api/generate
+// (Response set). Streams send one record per delta and a final one with Done.
+type OllamaResponse struct {
+	Model           string         `json:"model"`
+	CreatedAt       string         `json:"created_at"`
+	Message         *OllamaMessage `json:"message,omitempty"`
+	Response        *string        `json:"response,omitempty"`
+	Thinking        string         `json:"thinking,omitempty"`
+	Done            bool           `json:"done"`
+	DoneReason      string         `json:"done_reason,omitempty"`
+	TotalDuration   int64          `json:"total_duration,omitempty"`
+	PromptEvalCount int            `json:"prompt_eval_count,omitempty"`
+	EvalCount       int            `json:"eval_count,omitempty"`
+}
+
+func BuildOllamaChatRecord(content string, thinking string, model string) *OllamaResponse {
+	return &OllamaResponse{
+		Model:     model,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Message:   &OllamaMessage{Role: "assistant", Content: content, Thinking: thinking},
+	}
+}
+
+func BuildOllamaGenerateRecord(content string, thinking string, model string) *OllamaResponse {
+	return &OllamaResponse{
+		Model:     model,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Response:  &content,
+		Thinking:  thinking,
+	}
+}
+
+// Finish marks a record as the last one of a response.
+func (r *OllamaResponse) Finish(finishReason string, duration time.Duration, promptTokens int, completionTokens int) *OllamaResponse {
+	r.Done = true
+	r.DoneReason = finishReason
+	r.TotalDuration = duration.Nanoseconds()
+	r.PromptEvalCount = promptTokens
+	r.EvalCount = completionTokens
+	return r
+}
+
+type ollamaModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// OllamaError is the body of an error response, and the last record of a
+// stream that failed.
+type OllamaError struct {
+	Error string `json:"error"`
+}
+
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    ollamaModelDetails `json:"details"`
+}
+
+type OllamaModelList struct {
+	Models []OllamaModel `json:"models"`
+}
+
+func OllamaTags(models []string) *OllamaModelList {
+	modelList := make([]OllamaModel, len(models))
+	for i, model := range models {
+		modelList[i] = OllamaModel{
+			Name:       model,
+			Model:      model,
+			ModifiedAt: time.Now().UTC().Format(time.RFC3339Nano),
+			Details: ollamaModelDetails{
+				Format:   "api",
+				Family:   "grok",
+				Families: []string{"grok"},
+			},
+		}
+	}
+	return &OllamaModelList{Models: modelList}
+}
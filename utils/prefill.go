@@ -0,0 +1,23 @@
+package utils
+
+// Prefill returns the text of a trailing assistant message, which the answer
+// is to continue, or "" when the conversation ends with another turn.
+func Prefill(msgs []Message) string {
+	if len(msgs) == 0 {
+		return ""
+	}
+	last := msgs[len(msgs)-1]
+	if last.Role != "assistant" || len(last.ToolCalls) > 0 {
+		return ""
+	}
+	return last.Content.Text()
+}
+
+// FormatPrefill returns the system message placed after an unfinished
+// assistant message, asking Grok to continue it.
+func FormatPrefill(prefill string) []Message {
+	if prefill == "" {
+		return nil
+	}
+	return SystemMessages("The last assistant message is unfinished. Continue it from exactly where it stops, without repeating any of it and without any introduction.")
+}
@@ -0,0 +1,27 @@
+package utils
+
+import "testing"
+
+func TestPrefill(t *testing.T) {
+	user := Message{Role: "user", Content: TextContent("Count to three.")}
+	tests := []struct {
+		name string
+		msgs []Message
+		want string
+	}{
+		{"no messages", nil, ""},
+		{"ends with the user", []Message{user}, ""},
+		{"ends with the assistant", []Message{user, {Role: "assistant", Content: TextContent("One, two,")}}, "One, two,"},
+		{"ends with tool calls", []Message{user, {Role: "assistant", ToolCalls: []ToolCall{{ID: "c", Function: FunctionCall{Name: "count"}}}}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Prefill(tt.msgs); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if got := FormatPrefill(tt.want); (len(got) > 0) != (tt.want != "") {
+				t.Errorf("FormatPrefill(%q) returned %d messages", tt.want, len(got))
+			}
+		})
+	}
+}
@@ -3,21 +3,201 @@ package utils
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
 )
 
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+	// Refusal is the text of a refusal part in an assistant message
+	Refusal string `json:"refusal,omitempty"`
+}
+
+// MessageContent is either a plain string or a list of content parts.
+type MessageContent []ContentPart
+
+func TextContent(text string) MessageContent {
+	return MessageContent{{Type: "text", Text: text}}
+}
+
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = TextContent(text)
+		return nil
+	}
+	if string(data) == "null" {
+		*c = nil
+		return nil
+	}
+	var parts []ContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*c = parts
+	return nil
+}
+
+// Text joins the text and refusal parts.
+func (c MessageContent) Text() string {
+	var texts []string
+	for _, part := range c {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "refusal":
+			texts = append(texts, part.Refusal)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Images returns the urls of the image parts, in order.
+func (c MessageContent) Images() []string {
+	var urls []string
+	for _, part := range c {
+		if part.Type == "image_url" && part.ImageURL != nil {
+			urls = append(urls, part.ImageURL.URL)
+		}
+	}
+	return urls
+}
+
+// promptText renders the content for the prompt, leaving a marker where each
+// image was so that Grok can tell which attachment belongs to which message.
+// images counts the images seen so far across messages.
+func (c MessageContent) promptText(images *int) string {
+	var texts []string
+	for _, part := range c {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "refusal":
+			texts = append(texts, part.Refusal)
+		case "image_url":
+			*images++
+			texts = append(texts, fmt.Sprintf("[image %d]", *images))
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	// Role is user, assistant, system, developer, tool or the older function
+	Role string `json:"role"`
+	// Name tells apart participants sharing a role, or names the function
+	// a function message answers
+	Name    string         `json:"name,omitempty"`
+	Content MessageContent `json:"content"`
+	// Refusal is set instead of the content when the assistant refused
+	Refusal    string     `json:"refusal,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+var (
+	// validName is what OpenAI accepts for participant and function names
+	validName   = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	validCallID = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,256}$`)
+)
+
+// ValidateMessages checks that every message has a known role and only
+// content the prompt can carry. Names and tool call ids are written into the
+// prompt, so they are held to the characters the API allows for them.
+func ValidateMessages(msgs []Message) error {
+	for i, msg := range msgs {
+		switch msg.Role {
+		case "user", "assistant", "system", "developer", "tool", "function":
+		default:
+			return fmt.Errorf("messages[%d]: unsupported role %q", i, msg.Role)
+		}
+		if msg.Name != "" && !validName.MatchString(msg.Name) {
+			return fmt.Errorf("messages[%d].name: %q does not match %s", i, msg.Name, validName)
+		}
+		if msg.Role == "function" && msg.Name == "" {
+			return fmt.Errorf("messages[%d].name: required for function messages", i)
+		}
+		if msg.Role == "tool" && !validCallID.MatchString(msg.ToolCallID) {
+			return fmt.Errorf("messages[%d].tool_call_id: %q does not match %s", i, msg.ToolCallID, validCallID)
+		}
+		for j, call := range msg.ToolCalls {
+			if !validName.MatchString(call.Function.Name) {
+				return fmt.Errorf("messages[%d].tool_calls[%d].function.name: %q does not match %s", i, j, call.Function.Name, validName)
+			}
+			if call.ID != "" && !validCallID.MatchString(call.ID) {
+				return fmt.Errorf("messages[%d].tool_calls[%d].id: %q does not match %s", i, j, call.ID, validCallID)
+			}
+		}
+		for j, part := range msg.Content {
+			switch part.Type {
+			case "text", "image_url", "refusal":
+			default:
+				return fmt.Errorf("messages[%d].content[%d]: unsupported content part type %q", i, j, part.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// MessageImages returns the urls of all images in the messages, in the order
+// they are numbered in the prompt.
+func MessageImages(msgs []Message) []string {
+	var urls []string
+	for _, msg := range msgs {
+		switch msg.Role {
+		case "user", "assistant", "system", "developer":
+			urls = append(urls, msg.Content.Images()...)
+		}
+	}
+	return urls
+}
+
+type StreamOptions struct {
+	// IncludeUsage asks for a last chunk reporting token usage.
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// Usage reports whether a stream should end with a usage chunk.
+func (o *StreamOptions) Usage() bool {
+	return o != nil && o.IncludeUsage
 }
 
 type OpenAIRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Temperature float64   `json:"temperature,omitempty"`
-	TopP        float64   `json:"top_p,omitempty"`
-	TopK        int       `json:"top_k,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Stream      bool      `json:"stream,omitempty"`
+	Model               string          `json:"model"`
+	Messages            []Message       `json:"messages"`
+	Temperature         float64         `json:"temperature,omitempty"`
+	TopP                float64         `json:"top_p,omitempty"`
+	TopK                int             `json:"top_k,omitempty"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"`
+	N                   int             `json:"n,omitempty"`
+	Stop                StopSequences   `json:"stop,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+	StreamOptions       *StreamOptions  `json:"stream_options,omitempty"`
+	Tools               []Tool          `json:"tools,omitempty"`
+	ToolChoice          ToolChoice      `json:"tool_choice,omitempty"`
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+	// ReasoningMode overrides the server's reasoning mode: inline, separate or none.
+	ReasoningMode string `json:"reasoning_mode,omitempty"`
+	// Grok overrides the model's Grok options for this request.
+	Grok *GrokOptions `json:"grok,omitempty"`
+}
+
+// TokenLimit returns the most tokens the answer may use, or 0 for no limit.
+// Newer clients send max_completion_tokens in place of max_tokens.
+func (r *OpenAIRequest) TokenLimit() int {
+	if r.MaxCompletionTokens > 0 {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
 }
 
 func ParseRequest(request string) (*OpenAIRequest, error) {
@@ -29,25 +209,13 @@ func ParseRequest(request string) (*OpenAIRequest, error) {
 	return &openAIRequest, nil
 }
 
-func formatPrompt(msgs []Message, roleMap map[string]string) string {
-	var prompt string
-	for _, msg := range msgs {
-		switch msg.Role {
-		case "user":
-			prompt += roleMap["user"] + ": " + msg.Content + "\n\n"
-		case "assistant":
-			prompt += roleMap["assistant"] + ": " + msg.Content + "\n\n"
-		case "system":
-			prompt += roleMap["system"] + ": " + msg.Content + "\n\n"
-		}
-	}
-	return prompt
-}
-
+// roleMap holds the label each role is given in the prompt.
 var roleMap = map[string]string{
 	"user":      "human",
 	"assistant": "assistant",
 	"system":    "system",
+	"developer": "developer",
+	"tool":      "tool",
 }
 
 func Base64Decode(input string) (*[]byte, error) {
@@ -58,13 +226,29 @@ func Base64Decode(input string) (*[]byte, error) {
 	return &decodedBytes, nil
 }
 
+// PromptHandler writes the messages with the default template.
 func PromptHandler(msgs []Message) string {
-	prompt := formatPrompt(msgs, roleMap)
-	return prompt
+	return defaultPromptTemplate.Format(msgs)
 }
 
-func ConfigureRoleMap(userRole, assistantRole, systemRole string) {
-	roleMap["user"] = userRole
-	roleMap["assistant"] = assistantRole
-	roleMap["system"] = systemRole
+// ConfigureRoleMap relabels roles in the prompt from a comma separated list
+// of role=label pairs, e.g. "user=user,assistant=grok".
+func ConfigureRoleMap(spec string) error {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		role, label, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		role, label = strings.TrimSpace(role), strings.TrimSpace(label)
+		if !ok || label == "" {
+			return fmt.Errorf("expected role=label, got %q", pair)
+		}
+		if _, known := roleMap[role]; !known {
+			return fmt.Errorf("unknown role %q", role)
+		}
+		labels[role] = label
+	}
+	for role, label := range labels {
+		roleMap[role] = label
+	}
+	rolePrefix = rolePrefixPattern()
+	return nil
 }
@@ -10,7 +10,14 @@ type grokChunk struct {
 }
 
 type grokResult struct {
-	Response json.RawMessage `json:"response"`
+	Response     json.RawMessage   `json:"response"`
+	Conversation *grokConversation `json:"conversation"`
+	// a continued conversation sends the response fields in the result itself
+	grokResponse
+}
+
+type grokConversation struct {
+	ConversationId string `json:"conversationId"`
 }
 
 type grokResponse struct {
@@ -28,7 +35,10 @@ func ParseGrokResponse(data string) (*grokResponse, error) {
 		return nil, err
 	}
 	if chunk.Result.Response == nil {
-		return nil, nil
+		if chunk.Result.grokResponse == (grokResponse{}) {
+			return nil, nil
+		}
+		return &chunk.Result.grokResponse, nil
 	}
 	var finalResponse grokResponse
 	if err := json.Unmarshal(chunk.Result.Response, &finalResponse); err != nil {
@@ -37,9 +47,39 @@ func ParseGrokResponse(data string) (*grokResponse, error) {
 	return &finalResponse, nil
 }
 
+// GrokStreamError is an error Grok reports in place of a response line.
+type GrokStreamError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type grokErrorLine struct {
+	Error *GrokStreamError `json:"error"`
+}
+
+// ParseGrokError returns the error carried by a line, or nil when the line is
+// not an error.
+func ParseGrokError(data string) (*GrokStreamError, error) {
+	var line grokErrorLine
+	if err := json.Unmarshal([]byte(data), &line); err != nil {
+		return nil, err
+	}
+	return line.Error, nil
+}
+
+func ParseGrokConversation(data string) (*grokConversation, error) {
+	var chunk grokChunk
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return nil, err
+	}
+	return chunk.Result.Conversation, nil
+}
+
 type openAIStreamChoiceDelta struct {
-	Content string `json:"content,omitempty"`
-	Role    string `json:"role,omitempty"`
+	Content          string     `json:"content,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	Role             string     `json:"role,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type openAIStreamChoice struct {
@@ -54,6 +94,53 @@ type OpenAIStreamingResponseChunk struct {
 	Created int64                `json:"created"`
 	Model   string               `json:"model"`
 	Choices []openAIStreamChoice `json:"choices"`
+	Usage   *OpenAIUsage         `json:"usage,omitempty"`
+}
+
+type openAIMessage struct {
+	Role             string     `json:"role"`
+	Content          string     `json:"content"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int           `json:"index"`
+	Message      openAIMessage `json:"message"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+type openAICompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens            int                           `json:"prompt_tokens"`
+	CompletionTokens        int                           `json:"completion_tokens"`
+	TotalTokens             int                           `json:"total_tokens"`
+	CompletionTokensDetails openAICompletionTokensDetails `json:"completion_tokens_details"`
+}
+
+type OpenAIResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   OpenAIUsage    `json:"usage"`
+}
+
+type openAIErrorBody struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// OpenAIError is the body of an error response, also sent in band when a
+// stream fails.
+type OpenAIError struct {
+	Error openAIErrorBody `json:"error"`
 }
 
 type OpenAIModel struct {
@@ -68,13 +155,14 @@ type OpenAIModelList struct {
 	Data   []OpenAIModel `json:"data"`
 }
 
-func BuildChunkStart(delta string, requestId string, model string) *OpenAIStreamingResponseChunk {
+func BuildChunkStart(delta string, reasoning string, requestId string, model string) *OpenAIStreamingResponseChunk {
 	choices := []openAIStreamChoice{
 		{
 			Index: 0,
 			Delta: openAIStreamChoiceDelta{
-				Content: delta,
-				Role:    "assistant",
+				Content:          delta,
+				ReasoningContent: reasoning,
+				Role:             "assistant",
 			},
 			FinishReason: nil,
 		},
@@ -88,12 +176,13 @@ func BuildChunkStart(delta string, requestId string, model string) *OpenAIStream
 	}
 }
 
-func BuildChunk(delta string, requestId string, model string) *OpenAIStreamingResponseChunk {
+func BuildChunk(delta string, reasoning string, requestId string, model string) *OpenAIStreamingResponseChunk {
 	choices := []openAIStreamChoice{
 		{
 			Index: 0,
 			Delta: openAIStreamChoiceDelta{
-				Content: delta,
+				Content:          delta,
+				ReasoningContent: reasoning,
 			},
 			FinishReason: nil,
 		},
@@ -107,8 +196,14 @@ func BuildChunk(delta string, requestId string, model string) *OpenAIStreamingRe
 	}
 }
 
-func BuildChunkFinish(requestID string, model string) *OpenAIStreamingResponseChunk {
-	finishReason := "stop"
+func BuildChunkToolCalls(toolCalls []ToolCall, requestId string, model string) *OpenAIStreamingResponseChunk {
+	chunk := BuildChunk("", "", requestId, model)
+	chunk.Choices[0].Delta.Role = "assistant"
+	chunk.Choices[0].Delta.ToolCalls = toolCalls
+	return chunk
+}
+
+func BuildChunkFinish(requestID string, model string, finishReason string) *OpenAIStreamingResponseChunk {
 	choices := []openAIStreamChoice{
 		{
 			Index: 0,
@@ -127,6 +222,84 @@ func BuildChunkFinish(requestID string, model string) *OpenAIStreamingResponseCh
 	}
 }
 
+// ForChoice sets the choice index of the chunk, for responses with n > 1.
+func (c *OpenAIStreamingResponseChunk) ForChoice(index int) *OpenAIStreamingResponseChunk {
+	for i := range c.Choices {
+		c.Choices[i].Index = index
+	}
+	return c
+}
+
+// BuildChunkUsage builds the last chunk of a stream that asked for usage,
+// which carries no choices.
+func BuildChunkUsage(requestID string, model string, usage OpenAIUsage) *OpenAIStreamingResponseChunk {
+	return &OpenAIStreamingResponseChunk{
+		ID:      requestID,
+		Object:  "chat.completion.chunk",
+		Created: 0,
+		Model:   model,
+		Choices: []openAIStreamChoice{},
+		Usage:   &usage,
+	}
+}
+
+func BuildResponse(content string, reasoning string, toolCalls []ToolCall, requestID string, model string, finishReason string, usage OpenAIUsage) *OpenAIResponse {
+	for i := range toolCalls {
+		toolCalls[i].Index = nil
+	}
+	choices := []openAIChoice{
+		{
+			Index: 0,
+			Message: openAIMessage{
+				Role:             "assistant",
+				Content:          content,
+				ReasoningContent: reasoning,
+				ToolCalls:        toolCalls,
+			},
+			FinishReason: finishReason,
+		},
+	}
+	return &OpenAIResponse{
+		ID:      requestID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: choices,
+		Usage:   usage,
+	}
+}
+
+// AddChoice appends the choice of other as the next one. Its completion
+// tokens are added to the usage, the prompt is only counted once.
+func (r *OpenAIResponse) AddChoice(other *OpenAIResponse) {
+	for _, choice := range other.Choices {
+		choice.Index = len(r.Choices)
+		r.Choices = append(r.Choices, choice)
+	}
+	r.Usage.CompletionTokens += other.Usage.CompletionTokens
+	r.Usage.TotalTokens += other.Usage.CompletionTokens
+	r.Usage.CompletionTokensDetails.ReasoningTokens += other.Usage.CompletionTokensDetails.ReasoningTokens
+}
+
+// BuildUsage reports token counts. reasoningTokens are part of completionTokens.
+func BuildUsage(promptTokens int, completionTokens int, reasoningTokens int) OpenAIUsage {
+	return OpenAIUsage{
+		PromptTokens:            promptTokens,
+		CompletionTokens:        completionTokens,
+		TotalTokens:             promptTokens + completionTokens,
+		CompletionTokensDetails: openAICompletionTokensDetails{ReasoningTokens: reasoningTokens},
+	}
+}
+
+// BuildOpenAIError builds an error object, code may be empty.
+func BuildOpenAIError(message string, errType string, code string) *OpenAIError {
+	body := openAIErrorBody{Message: message, Type: errType}
+	if code != "" {
+		body.Code = &code
+	}
+	return &OpenAIError{Error: body}
+}
+
 func ModelList(models []string) *OpenAIModelList {
 	modelList := make([]OpenAIModel, len(models))
 	for i, model := range models {
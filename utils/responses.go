@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type ResponsesContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+// ResponsesInputContent is either a plain string or a list of content parts.
+type ResponsesInputContent []ResponsesContentPart
+
+func (c *ResponsesInputContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ResponsesInputContent{{Type: "input_text", Text: text}}
+		return nil
+	}
+	var parts []ResponsesContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*c = parts
+	return nil
+}
+
+// Text joins the text parts, whether they came from the user or the model.
+func (c ResponsesInputContent) Text() string {
+	var parts []string
+	for _, part := range c {
+		if part.Type == "input_text" || part.Type == "output_text" || part.Type == "text" {
+			parts = append(parts, part.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Content converts the parts Grok can take into message content.
+func (c ResponsesInputContent) Content() MessageContent {
+	var content MessageContent
+	for _, part := range c {
+		switch part.Type {
+		case "input_text", "output_text", "text":
+			content = append(content, ContentPart{Type: "text", Text: part.Text})
+		case "input_image":
+			if part.ImageURL != "" {
+				content = append(content, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: part.ImageURL}})
+			}
+		}
+	}
+	return content
+}
+
+type ResponsesInputItem struct {
+	Type    string                `json:"type,omitempty"`
+	Role    string                `json:"role,omitempty"`
+	Content ResponsesInputContent `json:"content,omitempty"`
+}
+
+// ResponsesInput is either a plain string, taken as one user message, or a list of items.
+type ResponsesInput []ResponsesInputItem
+
+func (in *ResponsesInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = ResponsesInput{{Type: "message", Role: "user", Content: ResponsesInputContent{{Type: "input_text", Text: text}}}}
+		return nil
+	}
+	var items []ResponsesInputItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	*in = items
+	return nil
+}
+
+type responsesReasoning struct {
+	Effort  string `json:"effort,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+type ResponsesRequest struct {
+	Model           string              `json:"model"`
+	Input           ResponsesInput      `json:"input"`
+	Instructions    string              `json:"instructions,omitempty"`
+	MaxOutputTokens int                 `json:"max_output_tokens,omitempty"`
+	Temperature     float64             `json:"temperature,omitempty"`
+	TopP            float64             `json:"top_p,omitempty"`
+	Stream          bool                `json:"stream,omitempty"`
+	Reasoning       *responsesReasoning `json:"reasoning,omitempty"`
+	// ReasoningMode overrides the server's reasoning mode: inline, separate or none.
+	ReasoningMode string `json:"reasoning_mode,omitempty"`
+	// Grok overrides the model's Grok options for this request.
+	Grok *GrokOptions `json:"grok,omitempty"`
+}
+
+// SummaryRequested reports whether the client asked for reasoning summaries.
+func (r *ResponsesRequest) SummaryRequested() bool {
+	return r.Reasoning != nil && r.Reasoning.Summary != ""
+}
+
+// ToMessages converts the request into the messages used to build the prompt.
+// Instructions are sent as a system message.
+func (r *ResponsesRequest) ToMessages() []Message {
+	var msgs []Message
+	if r.Instructions != "" {
+		msgs = append(msgs, Message{Role: "system", Content: TextContent(r.Instructions)})
+	}
+	for _, item := range r.Input {
+		if item.Type != "" && item.Type != "message" {
+			continue
+		}
+		msgs = append(msgs, Message{Role: item.Role, Content: item.Content.Content()})
+	}
+	return msgs
+}
+
+type ResponsesOutputContent struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type ResponsesSummaryPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type ResponsesOutputItem struct {
+	Type    string                   `json:"type"`
+	ID      string                   `json:"id"`
+	Status  string                   `json:"status,omitempty"`
+	Role    string                   `json:"role,omitempty"`
+	Content []ResponsesOutputContent `json:"content,omitempty"`
+	Summary []ResponsesSummaryPart   `json:"summary,omitempty"`
+}
+
+// MarshalJSON always writes the list matching the item type, even when empty,
+// since clients expect it to be present.
+func (item ResponsesOutputItem) MarshalJSON() ([]byte, error) {
+	type plain ResponsesOutputItem
+	switch item.Type {
+	case "message":
+		content := item.Content
+		if content == nil {
+			content = []ResponsesOutputContent{}
+		}
+		return json.Marshal(struct {
+			plain
+			Content []ResponsesOutputContent `json:"content"`
+		}{plain(item), content})
+	case "reasoning":
+		summary := item.Summary
+		if summary == nil {
+			summary = []ResponsesSummaryPart{}
+		}
+		return json.Marshal(struct {
+			plain
+			Summary []ResponsesSummaryPart `json:"summary"`
+		}{plain(item), summary})
+	}
+	return json.Marshal(plain(item))
+}
+
+type responsesOutputTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+type ResponsesUsage struct {
+	InputTokens         int                          `json:"input_tokens"`
+	OutputTokens        int                          `json:"output_tokens"`
+	TotalTokens         int                          `json:"total_tokens"`
+	OutputTokensDetails responsesOutputTokensDetails `json:"output_tokens_details"`
+}
+
+func BuildResponsesUsage(inputTokens int, outputTokens int, reasoningTokens int) *ResponsesUsage {
+	return &ResponsesUsage{
+		InputTokens:         inputTokens,
+		OutputTokens:        outputTokens,
+		TotalTokens:         inputTokens + outputTokens,
+		OutputTokensDetails: responsesOutputTokensDetails{ReasoningTokens: reasoningTokens},
+	}
+}
+
+type ResponsesError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ResponsesIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type ResponsesResponse struct {
+	ID                string                      `json:"id"`
+	Object            string                      `json:"object"`
+	CreatedAt         int64                       `json:"created_at"`
+	Status            string                      `json:"status"`
+	Model             string                      `json:"model"`
+	Output            []ResponsesOutputItem       `json:"output"`
+	Usage             *ResponsesUsage             `json:"usage"`
+	Error             *ResponsesError             `json:"error"`
+	IncompleteDetails *ResponsesIncompleteDetails `json:"incomplete_details"`
+}
+
+// ResponsesStreamEvent is one server-sent event of a streamed response. Only
+// the fields relevant to the event type are set.
+type ResponsesStreamEvent struct {
+	Type           string               `json:"type"`
+	SequenceNumber int                  `json:"sequence_number"`
+	Response       *ResponsesResponse   `json:"response,omitempty"`
+	OutputIndex    *int                 `json:"output_index,omitempty"`
+	ContentIndex   *int                 `json:"content_index,omitempty"`
+	SummaryIndex   *int                 `json:"summary_index,omitempty"`
+	ItemID         string               `json:"item_id,omitempty"`
+	Item           *ResponsesOutputItem `json:"item,omitempty"`
+	Part           any                  `json:"part,omitempty"`
+	Delta          string               `json:"delta,omitempty"`
+	Text           *string              `json:"text,omitempty"`
+}
@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Built-in transcript formats, chosen by name wherever a template is.
+var promptPresets = map[string]string{
+	// plain is the "label: content" layout the proxy has always used
+	"plain": "{{range .Messages}}{{.Label}}{{with .Name}} ({{.}}){{end}}: {{.Content}}\n\n{{end}}",
+	"xml": "{{range .Messages}}<message role={{printf \"%q\" .Label}}{{with .Name}} name={{printf \"%q\" .}}{{end}}>\n" +
+		"{{.Content}}\n</message>\n\n{{end}}",
+	"chatml": "{{range .Messages}}<|im_start|>{{.Label}}{{with .Name}} name={{.}}{{end}}\n{{.Content}}<|im_end|>\n{{end}}",
+}
+
+// delimitedPresets mark where each message starts and ends, so a line starting
+// with a role label inside a message is just text there.
+var delimitedPresets = map[string]bool{"xml": true, "chatml": true}
+
+// PromptMessage is a message as seen by a prompt template. Content is already
+// escaped, see promptEscaper.
+type PromptMessage struct {
+	// Index is the position of the message in Messages
+	Index int
+	// Role is the API role, Label what it is called in the prompt
+	Role  string
+	Label string
+	Name  string
+	// Content is the text with image markers, tool calls and tool results
+	Content string
+	First   bool
+	Last    bool
+}
+
+// PromptData is what a prompt template is executed with.
+type PromptData struct {
+	Messages []PromptMessage
+	// System holds the system and developer messages and Turns the others,
+	// both in order
+	System []PromptMessage
+	Turns  []PromptMessage
+	// Roles maps each API role to its label
+	Roles map[string]string
+}
+
+// PromptTemplate renders messages into the transcript sent to Grok.
+type PromptTemplate struct {
+	Name     string
+	template *template.Template
+	// roleLines is set when messages may start with a role label on a line,
+	// as in the plain preset and possibly in template files
+	roleLines bool
+}
+
+var (
+	promptTemplatesMu sync.Mutex
+	promptTemplates   = map[string]*PromptTemplate{}
+)
+
+var defaultPromptTemplate = mustPromptTemplate("plain")
+
+func mustPromptTemplate(spec string) *PromptTemplate {
+	t, err := LoadPromptTemplate(spec)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// PromptPresets returns the names of the built-in templates.
+func PromptPresets() []string {
+	var names []string
+	for name := range promptPresets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// LoadPromptTemplate returns the built-in template named spec, or else parses
+// the file at spec. Templates are checked against sample messages and kept,
+// so loading the same spec again is cheap.
+func LoadPromptTemplate(spec string) (*PromptTemplate, error) {
+	promptTemplatesMu.Lock()
+	defer promptTemplatesMu.Unlock()
+	if t, ok := promptTemplates[spec]; ok {
+		return t, nil
+	}
+	text, ok := promptPresets[spec]
+	if !ok {
+		data, err := os.ReadFile(spec)
+		if err != nil {
+			return nil, fmt.Errorf("template %s is neither a preset (%s) nor a readable file: %v", spec, strings.Join(PromptPresets(), ", "), err)
+		}
+		text = string(data)
+	}
+	parsed, err := template.New(spec).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %v", spec, err)
+	}
+	t := &PromptTemplate{Name: spec, template: parsed, roleLines: !delimitedPresets[spec]}
+	sample := []Message{
+		{Role: "system", Content: TextContent("Be brief.")},
+		{Role: "user", Name: "alice", Content: TextContent("Hello")},
+		{Role: "assistant", Content: TextContent("Hi")},
+	}
+	if _, err := t.execute(sample); err != nil {
+		return nil, fmt.Errorf("failed to execute template %s: %v", spec, err)
+	}
+	promptTemplates[spec] = t
+	return t, nil
+}
+
+// ConfigurePromptTemplate sets the template used when neither the model nor
+// the API key has one.
+func ConfigurePromptTemplate(spec string) error {
+	t, err := LoadPromptTemplate(spec)
+	if err != nil {
+		return err
+	}
+	defaultPromptTemplate = t
+	return nil
+}
+
+// PromptTemplate returns the template the model's prompts are written with.
+func (m Model) PromptTemplate() *PromptTemplate {
+	if m.Template == "" {
+		return defaultPromptTemplate
+	}
+	t, err := LoadPromptTemplate(m.Template)
+	if err != nil {
+		// checked when the model or key was loaded
+		return defaultPromptTemplate
+	}
+	return t
+}
+
+// FormatPrompt writes the messages with the model's template.
+func (m Model) FormatPrompt(msgs []Message) string {
+	return m.PromptTemplate().Format(msgs)
+}
+
+// Format renders the messages. Should the template fail on them, the plain
+// layout is used instead.
+func (t *PromptTemplate) Format(msgs []Message) string {
+	prompt, err := t.execute(msgs)
+	if err != nil && t.Name != "plain" {
+		prompt, _ = mustPromptTemplate("plain").execute(msgs)
+	}
+	return prompt
+}
+
+func (t *PromptTemplate) execute(msgs []Message) (string, error) {
+	var b strings.Builder
+	if err := t.template.Execute(&b, promptData(msgs, t.roleLines)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// promptData prepares the messages for a template, numbering the images and
+// putting tool calls and results into the text. roleLines tells whether role
+// labels at the start of a line are escaped, see promptEscaper.
+func promptData(msgs []Message, roleLines bool) PromptData {
+	data := PromptData{Roles: make(map[string]string, len(roleMap))}
+	for role, label := range roleMap {
+		data.Roles[role] = label
+	}
+	escape := promptEscaper(roleLines)
+	images := 0
+	// tool results only carry the call id, the name comes from the call
+	toolNames := map[string]string{}
+	for _, msg := range msgs {
+		var content string
+		label, name := roleMap[msg.Role], promptName(escape, msg.Name)
+		switch msg.Role {
+		case "user", "system", "developer":
+			content = escape(msg.Content.promptText(&images))
+		case "assistant":
+			content = escape(msg.Content.promptText(&images))
+			if content == "" && msg.Refusal != "" {
+				content = escape(msg.Refusal)
+			}
+			if len(msg.ToolCalls) > 0 {
+				for _, call := range msg.ToolCalls {
+					toolNames[call.ID] = call.Function.Name
+				}
+				if content != "" {
+					content += "\n"
+				}
+				content += formatToolCalls(msg.ToolCalls)
+			}
+		case "tool", "function":
+			// function messages are the older form, named after the function
+			toolName, ok := toolNames[msg.ToolCallID]
+			if !ok {
+				toolName = msg.Name
+			}
+			content = formatToolResult(promptName(escape, toolName), msg.ToolCallID, escape(msg.Content.Text()))
+			label, name = roleMap["tool"], ""
+		default:
+			continue
+		}
+		data.Messages = append(data.Messages, PromptMessage{
+			Index:   len(data.Messages),
+			Role:    msg.Role,
+			Label:   label,
+			Name:    name,
+			Content: content,
+		})
+	}
+	for i := range data.Messages {
+		data.Messages[i].First = i == 0
+		data.Messages[i].Last = i == len(data.Messages)-1
+		if role := data.Messages[i].Role; role == "system" || role == "developer" {
+			data.System = append(data.System, data.Messages[i])
+		} else {
+			data.Turns = append(data.Turns, data.Messages[i])
+		}
+	}
+	return data
+}
+
+var (
+	promptMarkup = regexp.MustCompile(`(?i)<(\||/?(?:message|tool_result|tool_call)\b)`)
+	rolePrefix   = rolePrefixPattern()
+)
+
+// rolePrefixPattern matches a line beginning with a role or its label and a
+// colon, the way messages start in the plain preset. It is built again when
+// the labels change, see ConfigureRoleMap.
+func rolePrefixPattern() *regexp.Regexp {
+	labels := []string{}
+	for role, label := range roleMap {
+		labels = append(labels, regexp.QuoteMeta(role), regexp.QuoteMeta(label))
+	}
+	return regexp.MustCompile(`(?im)^([ \t]*)((?:` + strings.Join(labels, "|") + `)(?:[ \t]*\([^)\n]*\))?[ \t]*:)`)
+}
+
+// promptEscaper returns a function escaping what in message content could be
+// read as the start of another message: chat markup tokens, the tags of the
+// xml preset, of tool calls and of tool results, and with roleLines a line
+// beginning with a role label and a colon. A backslash is put in front, which
+// Grok reads past easily.
+func promptEscaper(roleLines bool) func(string) string {
+	return func(text string) string {
+		if roleLines {
+			text = rolePrefix.ReplaceAllString(text, `$1\$2`)
+		}
+		return promptMarkup.ReplaceAllString(text, `<\$1`)
+	}
+}
+
+// promptName puts a name on one line and escapes it like content, so that it
+// cannot close its message and start another in any template.
+func promptName(escape func(string) string, name string) string {
+	return escape(strings.Join(strings.Fields(name), " "))
+}
+
+// SystemMessages returns the text as a system message to add to a prompt,
+// or none when it is empty.
+func SystemMessages(text string) []Message {
+	if text == "" {
+		return nil
+	}
+	return []Message{{Role: "system", Content: TextContent(text)}}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// EstimateTokens approximates how many tokens a BPE tokenizer such as
+// cl100k makes of text. It has no vocabulary, so it cannot tell which pieces
+// merge: the text is only split the way the tokenizer splits it before
+// merging, into words with their leading space, runs of up to three digits,
+// punctuation and whitespace. Short words are taken as one token and longer
+// ones as one per four characters, while CJK and other scripts without spaces
+// count a token per character. Grok does not report usage, so the counts in
+// responses, max_tokens and context limits all rest on this estimate, which
+// can be off by a fair margin either way.
+func EstimateTokens(text string) int {
+	tokens := 0
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		switch {
+		case r == ' ' && startsWord(text[size:]):
+			// a single space is merged into the word that follows
+			text = text[size:]
+		case isDenseScript(r):
+			tokens++
+			text = text[size:]
+		case isWordRune(r):
+			n, rest := span(text, isWordRune)
+			tokens += wordTokens(n)
+			text = rest
+		case unicode.IsDigit(r):
+			n, rest := span(text, unicode.IsDigit)
+			tokens += (n + 2) / 3
+			text = rest
+		case unicode.IsSpace(r):
+			_, rest := span(text, unicode.IsSpace)
+			tokens++
+			text = rest
+		default:
+			// punctuation and symbols, where repeated characters merge well
+			n, rest := span(text, func(c rune) bool { return c == r })
+			tokens += (n + 3) / 4
+			text = rest
+		}
+	}
+	return tokens
+}
+
+// LastTokenBreak returns the last position past from where text can be split
+// without changing its estimate, so that the tokens of both parts add up to
+// those of text. It returns 0 when there is none. Counting a growing text
+// from its last break keeps each count short.
+func LastTokenBreak(text string, from int) int {
+	last := 0
+	prev, _ := utf8.DecodeLastRuneInString(text[:from])
+	for i, r := range text[from:] {
+		if i+from > 0 && tokenBreak(prev, r) {
+			last = i + from
+		}
+		prev = r
+	}
+	return last
+}
+
+// tokenBreak reports whether EstimateTokens ends a piece between prev and
+// next. A single space is not a break, as it is merged into a following word.
+func tokenBreak(prev, next rune) bool {
+	switch {
+	case prev == ' ':
+		return false
+	case unicode.IsSpace(prev):
+		return !unicode.IsSpace(next)
+	case isDenseScript(prev):
+		return true
+	case isWordRune(prev):
+		return !isWordRune(next)
+	case unicode.IsDigit(prev):
+		return !unicode.IsDigit(next)
+	default:
+		return next != prev
+	}
+}
+
+func wordTokens(runes int) int {
+	if runes <= 6 {
+		return 1
+	}
+	return (runes + 3) / 4
+}
+
+func startsWord(text string) bool {
+	r, _ := utf8.DecodeRuneInString(text)
+	return isWordRune(r) || isDenseScript(r)
+}
+
+// isWordRune reports letters that form space separated words.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) && !isDenseScript(r) || unicode.Is(unicode.Mn, r)
+}
+
+// isDenseScript reports scripts written without spaces, whose characters are
+// mostly tokens of their own.
+func isDenseScript(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Thai)
+}
+
+// span returns how many runes at the start of text satisfy f, and the rest.
+func span(text string, f func(rune) bool) (int, string) {
+	n := 0
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		if !f(r) {
+			break
+		}
+		n++
+		text = text[size:]
+	}
+	return n, text
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type ToolCall struct {
+	// Index is only set in streamed deltas.
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+// ToolChoice is "none", "auto", "required", or a named function.
+type ToolChoice struct {
+	Mode     string
+	Function string
+}
+
+func (c *ToolChoice) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		c.Mode = mode
+		return nil
+	}
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil {
+		return err
+	}
+	c.Mode = "function"
+	c.Function = named.Function.Name
+	return nil
+}
+
+// ValidateTools checks the names of the tools and of the chosen tool, which
+// are written into the prompt like message names, see ValidateMessages.
+func ValidateTools(tools []Tool, choice ToolChoice) error {
+	for i, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			// left out of the prompt, see FormatTools
+			continue
+		}
+		if !validName.MatchString(tool.Function.Name) {
+			return fmt.Errorf("tools[%d].function.name: %q does not match %s", i, tool.Function.Name, validName)
+		}
+	}
+	if choice.Mode == "function" && !validName.MatchString(choice.Function) {
+		return fmt.Errorf("tool_choice.function.name: %q does not match %s", choice.Function, validName)
+	}
+	return nil
+}
+
+// ToolsEnabled reports whether Grok should be told about the tools.
+func ToolsEnabled(tools []Tool, choice ToolChoice) bool {
+	return len(tools) > 0 && choice.Mode != "none"
+}
+
+const (
+	ToolCallOpenTag  = "<tool_call>"
+	ToolCallCloseTag = "</tool_call>"
+)
+
+// toolCallBlock is how a tool call is written in the prompt and expected back
+// from Grok.
+type toolCallBlock struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// FormatTools returns the tool definitions and the calling convention as a
+// system message to place before the conversation.
+func FormatTools(tools []Tool, choice ToolChoice) []Message {
+	if !ToolsEnabled(tools, choice) {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("You can call the following tools. Each tool is described by its name, a description and a JSON schema of its arguments.\n\n")
+	for _, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
+		}
+		parameters := tool.Function.Parameters
+		if len(parameters) == 0 {
+			parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		fmt.Fprintf(&b, "- name: %s\n", tool.Function.Name)
+		if tool.Function.Description != "" {
+			fmt.Fprintf(&b, "  description: %s\n", tool.Function.Description)
+		}
+		fmt.Fprintf(&b, "  parameters: %s\n", compactJSON(parameters))
+	}
+	b.WriteString("\nTo call a tool, write a block like this for each call, with the arguments as a JSON object matching the schema:\n")
+	fmt.Fprintf(&b, "%s\n{\"name\": \"<tool name>\", \"arguments\": {}}\n%s\n", ToolCallOpenTag, ToolCallCloseTag)
+	b.WriteString("When you call tools, write nothing after the last block and wait for the results, which will be given to you in tool messages. ")
+	switch choice.Mode {
+	case "required":
+		b.WriteString("You must call at least one tool in your reply.")
+	case "function":
+		fmt.Fprintf(&b, "You must call the tool %s in your reply.", choice.Function)
+	default:
+		b.WriteString("If no tool is needed, answer normally without any block.")
+	}
+	return SystemMessages(b.String())
+}
+
+// formatToolCalls writes the calls an assistant made earlier in the same
+// format Grok is asked to use.
+func formatToolCalls(calls []ToolCall) string {
+	var blocks []string
+	for _, call := range calls {
+		arguments := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(arguments) {
+			quoted, _ := json.Marshal(call.Function.Arguments)
+			arguments = quoted
+		}
+		block, _ := json.Marshal(toolCallBlock{Name: call.Function.Name, Arguments: arguments})
+		blocks = append(blocks, fmt.Sprintf("%s\n%s\n%s", ToolCallOpenTag, block, ToolCallCloseTag))
+	}
+	return strings.Join(blocks, "\n")
+}
+
+// formatToolResult wraps the output of a tool so Grok can match it to its call.
+func formatToolResult(name string, callID string, content string) string {
+	return fmt.Sprintf("<tool_result name=%q tool_call_id=%q>\n%s\n</tool_result>", name, callID, content)
+}
+
+// ParseToolCall reads the body of a tool call block written by Grok.
+func ParseToolCall(body string) (*FunctionCall, error) {
+	body = strings.TrimSpace(body)
+	// Grok sometimes wraps the JSON in a code fence
+	body = strings.TrimPrefix(body, "```json")
+	body = strings.TrimPrefix(body, "```")
+	body = strings.TrimSuffix(body, "```")
+	var block toolCallBlock
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &block); err != nil {
+		return nil, err
+	}
+	if block.Name == "" {
+		return nil, fmt.Errorf("tool call without a name")
+	}
+	arguments := "{}"
+	if len(block.Arguments) > 0 {
+		var text string
+		if err := json.Unmarshal(block.Arguments, &text); err == nil {
+			arguments = text
+		} else {
+			arguments = compactJSON(block.Arguments)
+		}
+	}
+	return &FunctionCall{Name: block.Name, Arguments: arguments}, nil
+}
+
+func compactJSON(data json.RawMessage) string {
+	var b strings.Builder
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return string(data)
+	}
+	if err := encoder.Encode(value); err != nil {
+		return string(data)
+	}
+	return strings.TrimSpace(b.String())
+}